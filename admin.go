@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// runPromoteAdminCommand makes an existing user an admin. It's how the
+// first admin is created; after that admins can promote others.
+func (cfg *apiConfig) runPromoteAdminCommand(args []string) error {
+	flags := flag.NewFlagSet("promote-admin", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: tubely promote-admin <email>")
+	}
+
+	email, err := normalizeEmail(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return fmt.Errorf("no user with email %s", email)
+	}
+
+	err = cfg.db.SetUserRole(user.ID, database.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now an admin\n", email)
+	return nil
+}
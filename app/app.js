@@ -1,4 +1,5 @@
 document.addEventListener('DOMContentLoaded', async () => {
+  await handleEmailLink();
   const token = localStorage.getItem('token');
 
   if (token) {
@@ -26,11 +27,10 @@ async function createVideoDraft() {
   const description = document.getElementById('video-description').value;
 
   try {
-    const res = await fetch('/api/videos', {
+    const res = await authFetch('/api/videos', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
       body: JSON.stringify({ title, description }),
     });
@@ -65,20 +65,76 @@ async function login() {
     if (!res.ok) {
       throw new Error(`Failed to login: ${data.error}`);
     }
-
-    if (data.token) {
-      localStorage.setItem('token', data.token);
-      document.getElementById('auth-section').style.display = 'none';
-      document.getElementById('video-section').style.display = 'block';
-      await getVideos();
-    } else {
-      alert('Login failed. Please check your credentials.');
-    }
+    await completeLogin(data);
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
 }
 
+// completeLogin stores the tokens from a login response, asking for a
+// second factor first if the account needs one.
+async function completeLogin(data) {
+  if (data.mfa_required) {
+    data = await loginMFA(data.mfa_token);
+  }
+
+  if (data.token) {
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refresh_token', data.refresh_token);
+    document.getElementById('auth-section').style.display = 'none';
+    document.getElementById('video-section').style.display = 'block';
+    await getVideos();
+  } else {
+    alert('Login failed. Please check your credentials.');
+  }
+}
+
+function loginSSO() {
+  window.location.href = '/api/oidc/login';
+}
+
+// loginOIDC finishes a single sign-on login with the token the server
+// redirected back with.
+async function loginOIDC(token) {
+  const res = await fetch('/api/login/oidc', {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify({ token }),
+  });
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(`Failed to login: ${data.error}`);
+  }
+  await completeLogin(data);
+}
+
+// loginMFA finishes logging in with a code from the user's authenticator
+// app or one of their recovery codes.
+async function loginMFA(mfaToken) {
+  const code = prompt('Enter the code from your authenticator app, or a recovery code');
+  if (!code) {
+    return {};
+  }
+  const body = /^\d{6}$/.test(code.trim())
+    ? { mfa_token: mfaToken, code: code.trim() }
+    : { mfa_token: mfaToken, recovery_code: code };
+
+  const res = await fetch('/api/login/mfa', {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify(body),
+  });
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(`Failed to login: ${data.error}`);
+  }
+  return data;
+}
+
 async function signup() {
   const email = document.getElementById('email').value;
   const password = document.getElementById('password').value;
@@ -102,12 +158,247 @@ async function signup() {
   }
 }
 
+async function forgotPassword() {
+  const email = document.getElementById('email').value;
+  if (!email) {
+    alert('Enter your email address first.');
+    return;
+  }
+
+  try {
+    const res = await fetch('/api/password_reset', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ email }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to request password reset: ${data.error}`);
+    }
+    alert('If that address has an account, we sent it a link to reset the password.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+// handleEmailLink completes email verification, an email change or a
+// password reset when the app is opened from a link in an email, or a
+// single sign-on login when the server redirects back to it.
+async function handleEmailLink() {
+  const params = new URLSearchParams(window.location.search);
+  const verifyToken = params.get('verify_email');
+  const changeEmailToken = params.get('change_email');
+  const resetToken = params.get('reset_password');
+  const oidcToken = params.get('oidc_login');
+  const oidcError = params.get('oidc_error');
+  if (!verifyToken && !changeEmailToken && !resetToken && !oidcToken && !oidcError) {
+    return;
+  }
+  window.history.replaceState(null, '', window.location.pathname);
+
+  if (oidcError) {
+    alert(`Error: ${oidcError}`);
+    return;
+  }
+  if (oidcToken) {
+    try {
+      await loginOIDC(oidcToken);
+    } catch (error) {
+      alert(`Error: ${error.message}`);
+    }
+    return;
+  }
+
+  try {
+    let res;
+    if (verifyToken) {
+      res = await fetch('/api/users/verify', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ token: verifyToken }),
+      });
+    } else if (changeEmailToken) {
+      res = await fetch('/api/email_change/confirm', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ token: changeEmailToken }),
+      });
+    } else {
+      const password = prompt('Choose a new password');
+      if (!password) {
+        return;
+      }
+      res = await fetch('/api/password_reset/confirm', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ token: resetToken, password }),
+      });
+    }
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(data.error);
+    }
+    if (verifyToken) {
+      alert('Your email address is verified.');
+    } else if (changeEmailToken) {
+      alert('Your email address was changed.');
+    } else {
+      localStorage.removeItem('token');
+      localStorage.removeItem('refresh_token');
+      alert('Your password was changed. Log in with your new password.');
+    }
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+// authFetch sends an authenticated request. Access tokens are short lived,
+// so when one is rejected it's refreshed once and the request retried.
+async function authFetch(url, options = {}) {
+  const send = () =>
+    fetch(url, {
+      ...options,
+      headers: {
+        ...options.headers,
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+
+  const res = await send();
+  if (res.status !== 401 || !(await refreshToken())) {
+    return res;
+  }
+  return send();
+}
+
+// Refresh tokens only work once, so concurrent requests share one refresh.
+let refreshing = null;
+
+function refreshToken() {
+  if (!refreshing) {
+    refreshing = rotateRefreshToken().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+}
+
+async function rotateRefreshToken() {
+  const token = localStorage.getItem('refresh_token');
+  if (!token) return false;
+
+  const res = await fetch('/api/refresh', {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${token}`,
+    },
+  });
+  if (!res.ok) {
+    logout();
+    return false;
+  }
+
+  const data = await res.json();
+  localStorage.setItem('token', data.token);
+  localStorage.setItem('refresh_token', data.refresh_token);
+  return true;
+}
+
 function logout() {
+  const refreshToken = localStorage.getItem('refresh_token');
+  if (refreshToken) {
+    fetch('/api/revoke', {
+      method: 'POST',
+      headers: {
+        Authorization: `Bearer ${refreshToken}`,
+      },
+    });
+  }
   localStorage.removeItem('token');
+  localStorage.removeItem('refresh_token');
   document.getElementById('auth-section').style.display = 'block';
   document.getElementById('video-section').style.display = 'none';
 }
 
+async function changePassword() {
+  const password = prompt('Enter your current password');
+  if (password === null) {
+    return;
+  }
+  const newPassword = prompt('Choose a new password');
+  if (!newPassword) {
+    return;
+  }
+  const code = prompt('Enter the code from your authenticator app, if you use one') || '';
+  const body = /^\d{6}$/.test(code.trim())
+    ? { password, new_password: newPassword, code: code.trim() }
+    : { password, new_password: newPassword, recovery_code: code };
+
+  try {
+    const res = await authFetch('/api/users/me/password', {
+      method: 'PUT',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(body),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to change password: ${data.error}`);
+    }
+    alert('Your password was changed. Your other sessions were logged out.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+// deleteAccount asks for the user's password, and a code if they use
+// two-factor authentication, before deleting their account. Users who only
+// log in with single sign-on can leave the password blank if they logged in
+// in the last few minutes.
+async function deleteAccount() {
+  if (!confirm('Delete your account and all of your videos? This can\'t be undone.')) {
+    return;
+  }
+  const password = prompt('Enter your password to confirm');
+  if (password === null) {
+    return;
+  }
+  const code = prompt('Enter the code from your authenticator app, if you use one') || '';
+  const body = /^\d{6}$/.test(code.trim())
+    ? { password, code: code.trim() }
+    : { password, recovery_code: code };
+
+  try {
+    const res = await authFetch('/api/users/me', {
+      method: 'DELETE',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(body),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to delete account: ${data.error}`);
+    }
+    alert('Your account is being deleted.');
+    localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
+    document.getElementById('auth-section').style.display = 'block';
+    document.getElementById('video-section').style.display = 'none';
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
 function setUploadButtonState(uploading, selector) {
   const uploadBtn = document.getElementById(selector);
   if (uploading) {
@@ -130,11 +421,8 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await authFetch(`/api/thumbnail_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -163,11 +451,8 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const res = await authFetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -188,26 +473,30 @@ const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
-      method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
-    });
-    if (!res.ok) {
-      const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
-    }
-
-    const videos = await res.json();
     const videoList = document.getElementById('video-list');
     videoList.innerHTML = '';
-    for (const video of videos) {
-      const listItem = document.createElement('li');
-      listItem.textContent = video.title;
-      listItem.onclick = () => videoStateHandler(video.id);
-      videoList.appendChild(listItem);
-    }
+
+    let cursor = null;
+    do {
+      const params = new URLSearchParams();
+      if (cursor) params.set('cursor', cursor);
+      const res = await authFetch(`/api/videos?${params}`, {
+        method: 'GET',
+      });
+      if (!res.ok) {
+        const data = await res.json();
+        throw new Error(`Failed to get videos. Error: ${data.error}`);
+      }
+
+      const page = await res.json();
+      for (const video of page.videos) {
+        const listItem = document.createElement('li');
+        listItem.textContent = video.title;
+        listItem.onclick = () => videoStateHandler(video.id);
+        videoList.appendChild(listItem);
+      }
+      cursor = page.next_cursor;
+    } while (cursor);
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
@@ -231,11 +520,8 @@ function createVideoStateHandler() {
 
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
+    const res = await authFetch(`/api/videos/${videoID}`, {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to get video.');
@@ -283,11 +569,8 @@ async function deleteVideo() {
   }
 
   try {
-    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+    const res = await authFetch(`/api/videos/${currentVideo.id}`, {
       method: 'DELETE',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to delete video.');
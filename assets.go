@@ -1,8 +1,7 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -16,16 +15,11 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(mediaType string) string {
-	b := make([]byte, 32)
-	_, err := rand.Read(b)
-	if err != nil {
-		panic("failed to generate random bytes")
-	}
-	base64Path := base64.RawURLEncoding.EncodeToString(b)
-
+// getAssetPath names an asset after the SHA-256 of its content, so the same
+// file uploaded twice maps to the same object.
+func getAssetPath(sum []byte, mediaType string) string {
 	ext := mediaTypeToExt(mediaType)
-	return fmt.Sprintf("%s%s", string(base64Path), ext)
+	return fmt.Sprintf("%s%s", hex.EncodeToString(sum), ext)
 }
 
 func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
@@ -40,6 +34,25 @@ func (cfg apiConfig) getVideoURL(key string) string {
 	return fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
 }
 
+// assetKeyFromURL reverses getAssetURL.
+func (cfg apiConfig) assetKeyFromURL(url string) (string, bool) {
+	key, ok := strings.CutPrefix(url, cfg.getAssetURL(""))
+	return key, ok && key != ""
+}
+
+// videoKeyFromStored returns the bucket key held in a video_url column.
+// Videos uploaded before playback URLs were signed stored the full
+// distribution URL instead of the key.
+func (cfg apiConfig) videoKeyFromStored(stored string) (string, bool) {
+	if key, ok := strings.CutPrefix(stored, cfg.getVideoURL("")); ok {
+		return key, key != ""
+	}
+	if strings.Contains(stored, "://") {
+		return "", false
+	}
+	return stored, stored != ""
+}
+
 func mediaTypeToExt(mediaType string) string {
 	parts := strings.Split(mediaType, "/")
 	if len(parts) != 2 {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// loginDelayAfter is the number of failed logins in a row before each
+	// further failure locks the account briefly, doubling from a second.
+	loginDelayAfter = 3
+	// lockoutAfter is the number of failed logins in a row that locks the
+	// account for lockoutDuration.
+	lockoutAfter    = 10
+	lockoutDuration = 15 * time.Minute
+)
+
+// loginLockout is how long an account is locked after its failures-th
+// failed login in a row.
+func loginLockout(failures int) time.Duration {
+	if failures < loginDelayAfter {
+		return 0
+	}
+	if failures >= lockoutAfter {
+		return lockoutDuration
+	}
+	return time.Second << (failures - loginDelayAfter)
+}
+
+func isLocked(user database.User) bool {
+	return user.LockedUntil != nil && time.Now().Before(*user.LockedUntil)
+}
+
+// respondWithLocked rejects a login to a locked account without checking
+// its credentials, so guessing can't continue during the lockout.
+func respondWithLocked(w http.ResponseWriter, user database.User) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(*user.LockedUntil))))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed logins, try again later", nil)
+}
+
+// recordLoginFailure counts a failed login against user, recording why it
+// failed and whether it locked them out. Once a full lockout has expired,
+// the count starts again, so the next failures are only delayed.
+func (cfg *apiConfig) recordLoginFailure(r *http.Request, user database.User, detail string) {
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventLoginFailed, detail)
+	updated, err := cfg.db.RecordLoginFailure(user.ID, lockoutAfter, loginLockout)
+	if err != nil {
+		log.Printf("Couldn't record failed login for user %s: %v", user.ID, err)
+		return
+	}
+	if updated.FailedLogins == lockoutAfter {
+		cfg.recordAuthEvent(r, user.ID, database.AuthEventLocked, "")
+	}
+}
+
+// recordAuthEvent adds an event to the audit log for userID, which may be
+// uuid.Nil. Failing to record an event doesn't fail the request.
+func (cfg *apiConfig) recordAuthEvent(r *http.Request, userID uuid.UUID, eventType database.AuthEventType, detail string) {
+	var id *uuid.UUID
+	if userID != uuid.Nil {
+		id = &userID
+	}
+	err := cfg.db.CreateAuthEvent(id, database.CreateAuthEventParams{
+		Type:          eventType,
+		Detail:        detail,
+		SessionClient: cfg.sessionClient(r),
+	})
+	if err != nil {
+		log.Printf("Couldn't record %s event: %v", eventType, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestLoginLockout(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{loginDelayAfter - 1, 0},
+		{loginDelayAfter, time.Second},
+		{loginDelayAfter + 1, 2 * time.Second},
+		{loginDelayAfter + 2, 4 * time.Second},
+		{lockoutAfter - 1, time.Second << (lockoutAfter - 1 - loginDelayAfter)},
+		{lockoutAfter, lockoutDuration},
+		{lockoutAfter + 5, lockoutDuration},
+	}
+	for _, tt := range tests {
+		if got := loginLockout(tt.failures); got != tt.want {
+			t.Errorf("loginLockout(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+	for failures := loginDelayAfter; failures < lockoutAfter; failures++ {
+		if loginLockout(failures) >= lockoutDuration {
+			t.Errorf("loginLockout(%d) = %s, at least the full lockout", failures, loginLockout(failures))
+		}
+	}
+}
+
+func TestIsLocked(t *testing.T) {
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Minute)
+	tests := []struct {
+		name        string
+		lockedUntil *time.Time
+		want        bool
+	}{
+		{name: "never locked", lockedUntil: nil},
+		{name: "lockout expired", lockedUntil: &past},
+		{name: "locked", lockedUntil: &future, want: true},
+	}
+	for _, tt := range tests {
+		if got := isLocked(database.User{LockedUntil: tt.lockedUntil}); got != tt.want {
+			t.Errorf("%s: isLocked() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+var errDigestMismatch = errors.New("uploaded file doesn't match the digest sent by the client")
+
+// uploadDigest is a checksum the client sent for the file it is uploading.
+// Content-Digest (RFC 9530) and Content-MD5 are accepted; both describe
+// the uploaded file rather than the whole multipart body.
+type uploadDigest struct {
+	algorithm string
+	expected  []byte
+	hash      hash.Hash
+}
+
+// parseUploadDigest returns nil if the client didn't send a digest. When
+// Content-Digest lists several algorithms the strongest supported one is
+// used.
+func parseUploadDigest(headers http.Header) (*uploadDigest, error) {
+	if header := headers.Get("Content-Digest"); header != "" {
+		digests := map[string][]byte{}
+		for _, member := range strings.Split(header, ",") {
+			algorithm, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return nil, fmt.Errorf("malformed Content-Digest member %q", member)
+			}
+			expected, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed Content-Digest value: %w", err)
+			}
+			digests[strings.ToLower(algorithm)] = expected
+		}
+		if expected, ok := digests["sha-512"]; ok {
+			return &uploadDigest{algorithm: "sha-512", expected: expected, hash: sha512.New()}, nil
+		}
+		if expected, ok := digests["sha-256"]; ok {
+			return &uploadDigest{algorithm: "sha-256", expected: expected, hash: sha256.New()}, nil
+		}
+		return nil, errors.New("Content-Digest must use sha-256 or sha-512")
+	}
+
+	if header := headers.Get("Content-MD5"); header != "" {
+		expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header))
+		if err != nil {
+			return nil, fmt.Errorf("malformed Content-MD5: %w", err)
+		}
+		return &uploadDigest{algorithm: "md5", expected: expected, hash: md5.New()}, nil
+	}
+
+	return nil, nil
+}
+
+// Write feeds the uploaded file through the digest as it is streamed.
+func (d *uploadDigest) Write(p []byte) (int, error) {
+	return d.hash.Write(p)
+}
+
+func (d *uploadDigest) Verify() error {
+	actual := d.hash.Sum(nil)
+	if !bytes.Equal(actual, d.expected) {
+		return fmt.Errorf("%w: %s was %s", errDigestMismatch, d.algorithm, base64.StdEncoding.EncodeToString(actual))
+	}
+	return nil
+}
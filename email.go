@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	passwordResetTTL     = time.Hour
+	// maxEmailLength is the longest address SMTP can deliver to.
+	maxEmailLength  = 254
+	mailSendTimeout = 30 * time.Second
+)
+
+var errInvalidEmail = errors.New("invalid email address")
+
+// normalizeEmail trims and lowercases an email address and checks it's a
+// bare address, without a display name. The local part is lowercased too:
+// no mail provider we'd deliver to treats it as case-sensitive, and keeping
+// one account per address matters more than the odd one that does.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if len(email) > maxEmailLength {
+		return "", errInvalidEmail
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", errInvalidEmail
+	}
+	return strings.ToLower(email), nil
+}
+
+// sendUserToken mails email a link containing a new single-use token for
+// purpose, issued to the user with userID. The message is sent in the
+// background so that slow mail servers don't hold up the request.
+func (cfg *apiConfig) sendUserToken(userID uuid.UUID, email string, purpose database.UserTokenPurpose) error {
+	var (
+		ttl     time.Duration
+		param   string
+		subject string
+		body    string
+	)
+	switch purpose {
+	case database.UserTokenVerifyEmail:
+		ttl = emailVerificationTTL
+		param = "verify_email"
+		subject = "Verify your Tubely email address"
+		body = "Follow this link to verify your email address:\n\n%s\n\nThe link expires in 48 hours."
+	case database.UserTokenResetPassword:
+		ttl = passwordResetTTL
+		param = "reset_password"
+		subject = "Reset your Tubely password"
+		body = "Follow this link to choose a new password:\n\n%s\n\nThe link expires in an hour. If you didn't ask to reset your password, you can ignore this email."
+	case database.UserTokenChangeEmail:
+		ttl = emailVerificationTTL
+		param = "change_email"
+		subject = "Confirm your new Tubely email address"
+		body = "Follow this link to change your Tubely account's email address to this one:\n\n%s\n\nThe link expires in 48 hours. If you didn't ask for this, you can ignore this email."
+	default:
+		return fmt.Errorf("unknown token purpose %q", purpose)
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return err
+	}
+	err = cfg.db.CreateUserToken(database.CreateUserTokenParams{
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		Hash:      auth.HashToken(token),
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := cfg.baseURL + "/app/?" + url.Values{param: {token}}.Encode()
+	go cfg.sendMail(mailer.Message{
+		To:      email,
+		Subject: subject,
+		Body:    fmt.Sprintf(body, link),
+	})
+	return nil
+}
+
+func (cfg *apiConfig) sendMail(msg mailer.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+	defer cancel()
+	if err := cfg.mailer.Send(ctx, msg); err != nil {
+		log.Printf("Couldn't send %q to %s: %v", msg.Subject, msg.To, err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// The keys getAssetPath generates: a SHA-256 of the content and an
+// extension. Videos are stored under a directory named for their aspect
+// ratio. Anything else in storage wasn't written by tubely's uploads, so
+// garbage collection leaves it alone.
+var (
+	assetObjectKey = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z0-9.+-]+$`)
+	videoObjectKey = regexp.MustCompile(`^(landscape|portrait|other)/[0-9a-f]{64}\.[a-z0-9.+-]+$`)
+)
+
+// isContentAddressed reports whether key is one tubely generates for kind.
+func isContentAddressed(kind database.UploadKind, key string) bool {
+	switch kind {
+	case database.UploadKindThumbnail:
+		return assetObjectKey.MatchString(key)
+	case database.UploadKindVideo:
+		return videoObjectKey.MatchString(key)
+	}
+	return false
+}
+
+// storedObject is an object found in one of the storage backends.
+type storedObject struct {
+	Kind    database.UploadKind
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// videoObjectRef is an object a video row points at.
+type videoObjectRef struct {
+	VideoID uuid.UUID
+	Kind    database.UploadKind
+	Key     string
+}
+
+type gcReport struct {
+	Orphans  []storedObject
+	Dangling []videoObjectRef
+	// Deleted counts the orphans older than the grace period that were
+	// removed. It stays zero on dry runs.
+	Deleted int
+	// Eligible counts the orphans older than the grace period, whether or
+	// not they were deleted.
+	Eligible int
+}
+
+// collectGarbage reconciles storage with the database. Objects that no video
+// or in-flight upload refers to are orphans; they're only deleted once
+// they're older than gracePeriod and dryRun is false.
+func (cfg *apiConfig) collectGarbage(ctx context.Context, gracePeriod time.Duration, dryRun bool) (gcReport, error) {
+	// List storage before reading references, so an upload that commits
+	// in between is seen as referenced rather than orphaned.
+	objects, err := cfg.listLocalAssets()
+	if err != nil {
+		return gcReport{}, fmt.Errorf("couldn't list assets: %w", err)
+	}
+	videoObjects, err := cfg.listVideoObjects(ctx)
+	if err != nil {
+		return gcReport{}, fmt.Errorf("couldn't list bucket: %w", err)
+	}
+	objects = append(objects, videoObjects...)
+
+	referenced, dangling, err := cfg.objectReferences()
+	if err != nil {
+		return gcReport{}, err
+	}
+
+	stored := map[string]bool{}
+	for _, object := range objects {
+		stored[string(object.Kind)+"/"+object.Key] = true
+	}
+
+	report := gcReport{}
+	for _, ref := range dangling {
+		// Objects with other keys aren't listed, so there's no telling
+		// whether they exist.
+		if !isContentAddressed(ref.Kind, ref.Key) {
+			continue
+		}
+		if !stored[string(ref.Kind)+"/"+ref.Key] {
+			report.Dangling = append(report.Dangling, ref)
+		}
+	}
+
+	cutoff := time.Now().Add(-gracePeriod)
+	for _, object := range objects {
+		if referenced[string(object.Kind)+"/"+object.Key] {
+			continue
+		}
+		report.Orphans = append(report.Orphans, object)
+		if object.ModTime.After(cutoff) {
+			continue
+		}
+		report.Eligible++
+		if dryRun {
+			continue
+		}
+		deleted, err := cfg.deleteOrphan(ctx, object)
+		if err != nil {
+			log.Printf("Couldn't delete orphaned %s object %s: %v", object.Kind, object.Key, err)
+			continue
+		}
+		if deleted {
+			report.Deleted++
+		}
+	}
+
+	return report, nil
+}
+
+// deleteOrphan deletes an orphaned object along with its asset record, if
+// it has one. It returns false, leaving the object alone, if its asset
+// gained a reference or is being uploaded again since the references were
+// read.
+func (cfg *apiConfig) deleteOrphan(ctx context.Context, object storedObject) (bool, error) {
+	deleted, err := cfg.db.DeleteAsset(object.Kind, object.Key, uuid.Nil)
+	if err != nil {
+		return false, fmt.Errorf("couldn't delete asset record: %w", err)
+	}
+	if !deleted {
+		asset, err := cfg.db.GetAsset(object.Kind, object.Key)
+		if err != nil {
+			return false, err
+		}
+		if asset.Key != "" {
+			return false, nil
+		}
+	}
+	if err := cfg.deleteObject(ctx, object.Kind, object.Key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// objectReferences returns the set of objects that must be kept, keyed by
+// kind and key, along with the objects video rows point at so they can be
+// checked for existence.
+func (cfg *apiConfig) objectReferences() (map[string]bool, []videoObjectRef, error) {
+	live, err := cfg.db.GetLiveObjects(time.Now().Add(time.Minute))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't list references: %w", err)
+	}
+
+	referenced := map[string]bool{}
+	pointedAt := []videoObjectRef{}
+	for _, ref := range live.Videos {
+		if ref.ThumbnailURL != nil {
+			if key, ok := cfg.assetKeyFromURL(*ref.ThumbnailURL); ok {
+				referenced[string(database.UploadKindThumbnail)+"/"+key] = true
+				pointedAt = append(pointedAt, videoObjectRef{ref.VideoID, database.UploadKindThumbnail, key})
+			}
+		}
+		if ref.VideoURL != nil {
+			if key, ok := cfg.videoKeyFromStored(*ref.VideoURL); ok {
+				referenced[string(database.UploadKindVideo)+"/"+key] = true
+				pointedAt = append(pointedAt, videoObjectRef{ref.VideoID, database.UploadKindVideo, key})
+			}
+		}
+	}
+	for _, upload := range live.Pending {
+		referenced[string(upload.Kind)+"/"+upload.Key] = true
+	}
+	for _, key := range live.Avatars {
+		referenced[string(database.UploadKindThumbnail)+"/"+key] = true
+	}
+	return referenced, pointedAt, nil
+}
+
+func (cfg *apiConfig) listLocalAssets() ([]storedObject, error) {
+	objects := []storedObject{}
+	err := filepath.WalkDir(cfg.assetsRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key, err := filepath.Rel(cfg.assetsRoot, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if !isContentAddressed(database.UploadKindThumbnail, key) {
+			return nil
+		}
+		objects = append(objects, storedObject{
+			Kind:    database.UploadKindThumbnail,
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+func (cfg *apiConfig) listVideoObjects(ctx context.Context) ([]storedObject, error) {
+	objects := []storedObject{}
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(cfg.s3Bucket),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			if !isContentAddressed(database.UploadKindVideo, aws.ToString(object.Key)) {
+				continue
+			}
+			objects = append(objects, storedObject{
+				Kind:    database.UploadKindVideo,
+				Key:     aws.ToString(object.Key),
+				Size:    aws.ToInt64(object.Size),
+				ModTime: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (report gcReport) print(out io.Writer, dryRun bool) {
+	sort.Slice(report.Orphans, func(i, j int) bool {
+		return report.Orphans[i].ModTime.Before(report.Orphans[j].ModTime)
+	})
+	for _, object := range report.Orphans {
+		fmt.Fprintf(out, "orphan\t%s\t%s\t%d bytes\t%s\n", object.Kind, object.Key, object.Size, object.ModTime.Format(time.RFC3339))
+	}
+	for _, ref := range report.Dangling {
+		fmt.Fprintf(out, "dangling\t%s\t%s\tvideo %s\n", ref.Kind, ref.Key, ref.VideoID)
+	}
+	fmt.Fprintf(out, "%d orphans, %d past the grace period, %d dangling references\n", len(report.Orphans), report.Eligible, len(report.Dangling))
+	if dryRun {
+		fmt.Fprintln(out, "Dry run, nothing was deleted. Re-run with -delete to remove orphans past the grace period.")
+	} else {
+		fmt.Fprintf(out, "Deleted %d orphans\n", report.Deleted)
+	}
+}
+
+// runGCCommand implements the `gc` subcommand. It is a dry run unless
+// -delete is given.
+func (cfg *apiConfig) runGCCommand(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	del := flags.Bool("delete", false, "delete orphans older than the grace period instead of only reporting them")
+	gracePeriod := flags.Duration("grace", cfg.gcGracePeriod, "how old an orphan must be before it is deleted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("gc takes no arguments")
+	}
+
+	report, err := cfg.collectGarbage(context.Background(), *gracePeriod, !*del)
+	if err != nil {
+		return err
+	}
+	report.print(os.Stdout, !*del)
+	return nil
+}
+
+func (cfg *apiConfig) runGarbageCollector(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		report, err := cfg.collectGarbage(ctx, cfg.gcGracePeriod, !cfg.gcDelete)
+		cancel()
+		if err != nil {
+			log.Printf("Garbage collection failed: %v", err)
+			continue
+		}
+		log.Printf("Garbage collection: %d orphans, %d past the grace period, %d deleted, %d dangling references",
+			len(report.Orphans), report.Eligible, report.Deleted, len(report.Dangling))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestIsContentAddressed(t *testing.T) {
+	sum := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		kind database.UploadKind
+		key  string
+		want bool
+	}{
+		{database.UploadKindThumbnail, sum + ".png", true},
+		{database.UploadKindThumbnail, sum + ".svg+xml", true},
+		{database.UploadKindThumbnail, sum, false},
+		{database.UploadKindThumbnail, sum + ".", false},
+		{database.UploadKindThumbnail, strings.ToUpper(sum) + ".png", false},
+		{database.UploadKindThumbnail, sum[1:] + ".png", false},
+		{database.UploadKindThumbnail, "landscape/" + sum + ".png", false},
+		{database.UploadKindThumbnail, "favicon.ico", false},
+		{database.UploadKindThumbnail, ".gitkeep", false},
+		{database.UploadKindVideo, "landscape/" + sum + ".mp4", true},
+		{database.UploadKindVideo, "portrait/" + sum + ".mp4", true},
+		{database.UploadKindVideo, "other/" + sum + ".mp4", true},
+		{database.UploadKindVideo, sum + ".mp4", false},
+		{database.UploadKindVideo, "backups/" + sum + ".mp4", false},
+		{database.UploadKindVideo, "landscape/nested/" + sum + ".mp4", false},
+		{database.UploadKindVideo, "landscape/intro.mp4", false},
+	}
+	for _, tt := range tests {
+		if got := isContentAddressed(tt.kind, tt.key); got != tt.want {
+			t.Errorf("isContentAddressed(%s, %q) = %v, want %v", tt.kind, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestListLocalAssets(t *testing.T) {
+	cfg := &apiConfig{assetsRoot: t.TempDir()}
+	sum := strings.Repeat("0123456789abcdef", 4)
+	for _, name := range []string{sum + ".png", "index.html", "nested/" + sum + ".png"} {
+		path := filepath.Join(cfg.assetsRoot, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("asset"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects, err := cfg.listLocalAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != sum+".png" {
+		t.Fatalf("listed %+v, want only %s.png", objects, sum)
+	}
+}
+
+func TestDeleteOrphan(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.assetsRoot = t.TempDir()
+	userID := createTestUser(t, cfg, "boots@example.com", "password")
+
+	tests := []struct {
+		name string
+		// staged starts an upload of the same content before the orphan
+		// is deleted.
+		staged      bool
+		wantDeleted bool
+	}{
+		{name: "orphan", wantDeleted: true},
+		{name: "uploaded again", staged: true, wantDeleted: false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := strings.Repeat(string("0123456789"[i]), 64) + ".png"
+			if err := os.WriteFile(cfg.getAssetDiskPath(key), []byte("asset"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := cfg.db.CreateAsset(database.CreateAssetParams{
+				Kind:      database.UploadKindThumbnail,
+				Key:       key,
+				SHA256:    strings.TrimSuffix(key, ".png"),
+				Size:      5,
+				MediaType: "image/png",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.staged {
+				video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: userID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = cfg.db.CreateUpload(database.CreateUploadParams{
+					VideoID: video.ID,
+					UserID:  userID,
+					Kind:    database.UploadKindThumbnail,
+					Key:     key,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deleted, err := cfg.deleteOrphan(context.Background(), storedObject{Kind: database.UploadKindThumbnail, Key: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+			asset, err := cfg.db.GetAsset(database.UploadKindThumbnail, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (asset.Key == "") != tt.wantDeleted {
+				t.Errorf("asset record = %+v, want it deleted: %v", asset, tt.wantDeleted)
+			}
+			_, err = os.Stat(cfg.getAssetDiskPath(key))
+			if os.IsNotExist(err) != tt.wantDeleted {
+				t.Errorf("stat = %v, want the file deleted: %v", err, tt.wantDeleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var startedAt = time.Now()
+
+func (cfg *apiConfig) handlerAdminUsersGet(w http.ResponseWriter, r *http.Request) {
+	users, err := cfg.db.GetUsers()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve users", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, users)
+}
+
+// adminTargetUser returns the user named in the path, responding with an
+// error if they don't exist or are the admin making the request.
+func adminTargetUser(cfg *apiConfig, w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return nil, false
+	}
+	// Admins can't lock themselves out.
+	if p, _ := requestPrincipal(r); p.UserID == userID {
+		respondWithError(w, http.StatusBadRequest, "You can't change your own account", nil)
+		return nil, false
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return nil, false
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return nil, false
+	}
+	return user, true
+}
+
+func (cfg *apiConfig) handlerAdminUserDisable(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminTargetUser(cfg, w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.DisableUser(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable user", err)
+		return
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventDisabled, "admin")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerAdminUserEnable(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminTargetUser(cfg, w, r)
+	if !ok {
+		return
+	}
+	if user.DeletedAt != nil {
+		respondWithError(w, http.StatusConflict, "User is being deleted", nil)
+		return
+	}
+
+	err := cfg.db.EnableUser(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable user", err)
+		return
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventEnabled, "admin")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerAdminUserUnlock lifts a lockout from too many failed logins
+// without waiting for it to expire.
+func (cfg *apiConfig) handlerAdminUserUnlock(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminTargetUser(cfg, w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.ResetLoginFailures(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't unlock user", err)
+		return
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventUnlocked, "admin")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerAdminUserRole(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role database.Role `json:"role"`
+	}
+
+	user, ok := adminTargetUser(cfg, w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !params.Role.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Role must be one of user, moderator, admin", nil)
+		return
+	}
+
+	err = cfg.db.SetUserRole(user.ID, params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set role", err)
+		return
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventRoleChanged, string(params.Role))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerAdminUserMFAReset turns off two-factor authentication for a user
+// who has lost their authenticator and recovery codes, so they can log in
+// with their password and enroll again.
+func (cfg *apiConfig) handlerAdminUserMFAReset(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminTargetUser(cfg, w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.DisableTOTP(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset two-factor authentication", err)
+		return
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventMFADisabled, "admin")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerAdminVideoTransfer(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	user, err := cfg.db.GetUser(params.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil || user.DisabledAt != nil {
+		respondWithError(w, http.StatusBadRequest, "Videos can only be transferred to active users", nil)
+		return
+	}
+
+	previousOwner := video.UserID
+	video, err = cfg.db.TransferVideo(video.ID, user.ID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't transfer video", err)
+		return
+	}
+	if previousOwner != user.ID {
+		cfg.recordAuthEvent(r, previousOwner, database.AuthEventVideoTransferred, video.ID.String())
+		cfg.recordAuthEvent(r, user.ID, database.AuthEventVideoTransferred, video.ID.String())
+	}
+
+	cfg.respondWithVideo(w, http.StatusOK, video)
+}
+
+// handlerAdminVideoDelete takes a video down by moving it to the trash, so
+// the owner's content is only lost once the trash is purged.
+func (cfg *apiConfig) handlerAdminVideoDelete(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	err = cfg.db.TrashVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		return
+	}
+	cfg.recordAuthEvent(r, video.UserID, database.AuthEventVideoTakenDown, video.ID.String())
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerAdminStatus(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.SystemStats
+		StartedAt time.Time `json:"started_at"`
+		Uptime    string    `json:"uptime"`
+		GoVersion string    `json:"go_version"`
+		Platform  string    `json:"platform"`
+		Search    string    `json:"search"`
+	}
+
+	stats, err := cfg.db.GetSystemStats()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get system stats", err)
+		return
+	}
+
+	search := "like"
+	if cfg.db.FullTextSearch() {
+		search = "fts5"
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		SystemStats: stats,
+		StartedAt:   startedAt.UTC(),
+		Uptime:      time.Since(startedAt).Round(time.Second).String(),
+		GoVersion:   runtime.Version(),
+		Platform:    cfg.platform,
+		Search:      search,
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// authEventTypes returns the types of userID's audit log events, newest
+// first.
+func authEventTypes(t *testing.T, cfg *apiConfig, userID uuid.UUID) []database.AuthEventType {
+	t.Helper()
+	page, err := cfg.db.GetAuthEvents(database.GetAuthEventsParams{UserID: &userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []database.AuthEventType{}
+	for _, event := range page.Events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestAdminActionsRecordEvents(t *testing.T) {
+	cfg := newTestConfig(t)
+	adminID := createTestUser(t, cfg, "admin@example.com", "password")
+	ownerID := createTestUser(t, cfg, "boots@example.com", "password")
+	recipientID := createTestUser(t, cfg, "fish@example.com", "password")
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: ownerID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminRequest := func(method, target, body string) *http.Request {
+		r := newUserRequest(method, target, body, adminID, "")
+		r.SetPathValue("userID", ownerID.String())
+		r.SetPathValue("videoID", video.ID.String())
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerAdminUserRole(w, adminRequest(http.MethodPut, "/admin/users/"+ownerID.String()+"/role", `{"role": "moderator"}`))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("role status = %d: %s", w.Code, w.Body)
+	}
+	if types := authEventTypes(t, cfg, ownerID); !slices.Contains(types, database.AuthEventRoleChanged) {
+		t.Errorf("owner's events = %v, want a role change", types)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerAdminVideoTransfer(w, adminRequest(http.MethodPost, "/admin/videos/"+video.ID.String()+"/transfer", `{"user_id": "`+recipientID.String()+`"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("transfer status = %d: %s", w.Code, w.Body)
+	}
+	for _, userID := range []uuid.UUID{ownerID, recipientID} {
+		if types := authEventTypes(t, cfg, userID); !slices.Contains(types, database.AuthEventVideoTransferred) {
+			t.Errorf("events of %s = %v, want a transfer", userID, types)
+		}
+	}
+	transferred, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transferred.Version != video.Version+1 {
+		t.Errorf("version after transfer = %d, want %d", transferred.Version, video.Version+1)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerAdminVideoDelete(w, adminRequest(http.MethodDelete, "/admin/videos/"+video.ID.String(), ""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("take down status = %d: %s", w.Code, w.Body)
+	}
+	if types := authEventTypes(t, cfg, recipientID); !slices.Contains(types, database.AuthEventVideoTakenDown) {
+		t.Errorf("recipient's events = %v, want a take down", types)
+	}
+
+	// Videos in the trash stay with the owner who trashed them.
+	w = httptest.NewRecorder()
+	cfg.handlerAdminVideoTransfer(w, adminRequest(http.MethodPost, "/admin/videos/"+video.ID.String()+"/transfer", `{"user_id": "`+ownerID.String()+`"}`))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("transferring a trashed video: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
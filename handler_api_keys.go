@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxAPIKeyNameLength = 100
+
+func (cfg *apiConfig) handlerAPIKeysCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name   string                 `json:"name"`
+		Scopes []database.APIKeyScope `json:"scopes"`
+	}
+	type response struct {
+		database.APIKey
+		Key string `json:"key"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxAPIKeyNameLength {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters", nil)
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required", nil)
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !scope.Valid() {
+			respondWithError(w, http.StatusBadRequest, "Scopes must be read, upload or delete", nil)
+			return
+		}
+	}
+
+	key, err := auth.MakeAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key", err)
+		return
+	}
+
+	apiKey, err := cfg.db.CreateAPIKey(database.CreateAPIKeyParams{
+		UserID: p.UserID,
+		Name:   params.Name,
+		Prefix: auth.APIKeyDisplayPrefix(key),
+		Hash:   auth.HashAPIKey(key),
+		Scopes: params.Scopes,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save API key", err)
+		return
+	}
+
+	// This is the only time the key itself is returned.
+	respondWithJSON(w, http.StatusCreated, response{
+		APIKey: apiKey,
+		Key:    key,
+	})
+}
+
+func (cfg *apiConfig) handlerAPIKeysGet(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	apiKeys, err := cfg.db.GetAPIKeys(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve API keys", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, apiKeys)
+}
+
+func (cfg *apiConfig) handlerAPIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(r.PathValue("keyID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	p, _ := requestPrincipal(r)
+
+	apiKey, err := cfg.db.GetAPIKey(keyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get API key", err)
+		return
+	}
+	if apiKey.ID == uuid.Nil || apiKey.RevokedAt != nil || apiKey.UserID != p.UserID {
+		respondWithError(w, http.StatusNotFound, "API key not found", nil)
+		return
+	}
+
+	err = cfg.db.RevokeAPIKey(apiKey.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke API key", err)
+		return
+	}
+	cfg.recordAuthEvent(r, p.UserID, database.AuthEventRevoke, "api_key")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// immutableAssetKey matches the names getAssetPath generates, along with
+// the random names it used to generate. Those are never reused for
+// different content, so they can be cached forever.
+var immutableAssetKey = regexp.MustCompile(`^([0-9a-f]{64}|[A-Za-z0-9_-]{43})\.[a-z0-9.+-]+$`)
+
+var errAssetChecksumMismatch = errors.New("asset content doesn't match its stored checksum")
+
+// assetETagCache remembers the content hash of each asset file so it is
+// only computed once per file version.
+type assetETagCache struct {
+	mu      sync.Mutex
+	entries map[string]assetETagEntry
+}
+
+type assetETagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func newAssetETagCache() *assetETagCache {
+	return &assetETagCache{entries: map[string]assetETagEntry{}}
+}
+
+// get returns a strong ETag for the file: a hash of its content, reused as
+// long as the file's size and modification time don't change. Whenever
+// either does, the hash is computed again and passed to verify, and only
+// cached if verify accepts it, so a file that changed on disk is checked
+// again before it's served.
+func (c *assetETagCache) get(diskPath string, f io.ReadSeeker, info fs.FileInfo, verify func(sha256Hex string) error) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[diskPath]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := verify(sum); err != nil {
+		return "", err
+	}
+	etag := `"` + sum + `"`
+
+	c.mu.Lock()
+	c.entries[diskPath] = assetETagEntry{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		etag:    etag,
+	}
+	c.mu.Unlock()
+	return etag, nil
+}
+
+// handlerAssets serves files from ASSETS_ROOT. http.ServeContent takes care
+// of Range requests and conditional requests against the ETag and
+// Last-Modified headers set here.
+func (cfg *apiConfig) handlerAssets(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/assets/")), "/")
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	diskPath := cfg.getAssetDiskPath(filepath.FromSlash(key))
+
+	f, err := os.Open(diskPath)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open asset", err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't stat asset", err)
+		return
+	}
+	if info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag, err := cfg.assetETags.get(diskPath, f, info, func(sum string) error {
+		asset, err := cfg.db.GetAssetByKey(key)
+		if err != nil {
+			return err
+		}
+		// Assets written before checksums were recorded have no row.
+		if asset.Key != "" && asset.SHA256 != sum {
+			return fmt.Errorf("%w: %s", errAssetChecksumMismatch, key)
+		}
+		return nil
+	})
+	if errors.Is(err, errAssetChecksumMismatch) {
+		respondWithError(w, http.StatusInternalServerError, "Asset failed its integrity check", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read asset", err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	if immutableAssetKey.MatchString(key) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
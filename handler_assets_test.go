@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestAssetsVerifyChecksum(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.assetsRoot = t.TempDir()
+	cfg.assetETags = newAssetETagCache()
+
+	content := []byte("boots")
+	sum := sha256.Sum256(content)
+	key := hex.EncodeToString(sum[:]) + ".png"
+	diskPath := filepath.Join(cfg.assetsRoot, key)
+	if err := os.WriteFile(diskPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := cfg.db.CreateAsset(database.CreateAssetParams{
+		Kind:      database.UploadKindThumbnail,
+		Key:       key,
+		SHA256:    hex.EncodeToString(sum[:]),
+		Size:      int64(len(content)),
+		MediaType: "image/png",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		cfg.handlerAssets(w, httptest.NewRequest(http.MethodGet, "/assets/"+key, nil))
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+
+	// The same size, but a new modification time, so the cached hash must
+	// be checked again.
+	if err := os.WriteFile(diskPath, []byte("fishy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(diskPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(); code != http.StatusInternalServerError {
+		t.Errorf("status after the file changed = %d, want %d", code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerAuthEventsGet(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+	cfg.listAuthEvents(w, r, database.GetAuthEventsParams{
+		UserID: &p.UserID,
+	})
+}
+
+// handlerAdminAuthEventsGet lists everyone's events, or one user's if the
+// user_id query parameter is set.
+func (cfg *apiConfig) handlerAdminAuthEventsGet(w http.ResponseWriter, r *http.Request) {
+	params := database.GetAuthEventsParams{}
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		userID, err := uuid.Parse(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+			return
+		}
+		params.UserID = &userID
+	}
+	cfg.listAuthEvents(w, r, params)
+}
+
+// listAuthEvents responds with one page of the events selected by params,
+// taking the limit and cursor from the query string.
+func (cfg *apiConfig) listAuthEvents(w http.ResponseWriter, r *http.Request, params database.GetAuthEventsParams) {
+	var err error
+	query := r.URL.Query()
+	params.Cursor = query.Get("cursor")
+	if limit := query.Get("limit"); limit != "" {
+		params.Limit, err = strconv.Atoi(limit)
+		if err != nil || params.Limit < 1 || params.Limit > database.MaxAuthEventPageLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", database.MaxAuthEventPageLimit), err)
+			return
+		}
+	}
+
+	page, err := cfg.db.GetAuthEvents(params)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve events", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, page)
+}
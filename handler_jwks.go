@@ -0,0 +1,10 @@
+package main
+
+import "net/http"
+
+// handlerJWKS publishes the public keys access tokens can be verified with.
+// Keys change rarely, but clients should pick up a new one within minutes.
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, cfg.jwtKeys.JWKS())
+}
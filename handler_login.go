@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -14,12 +16,6 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 		Email    string `json:"email"`
 	}
-	type response struct {
-		database.User
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-	}
-
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
@@ -28,47 +24,75 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(params.Email)
+	email, err := normalizeEmail(params.Email)
 	if err != nil {
+		cfg.recordAuthEvent(r, uuid.Nil, database.AuthEventLoginFailed, "unknown_email")
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
-
-	match, err := auth.CheckPasswordHash(params.Password, user.Password)
+	user, err := cfg.db.GetUserByEmail(email)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
-	if !match {
+	if user.Email == "" {
+		cfg.recordAuthEvent(r, uuid.Nil, database.AuthEventLoginFailed, "unknown_email")
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", nil)
 		return
 	}
+	if isLocked(user) {
+		cfg.recordAuthEvent(r, user.ID, database.AuthEventLoginFailed, "locked")
+		respondWithLocked(w, user)
+		return
+	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour*24*30,
-	)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+	match, err := auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil || !match {
+		cfg.recordLoginFailure(r, user, "password")
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		return
+	}
+	if user.DisabledAt != nil {
+		cfg.recordAuthEvent(r, user.ID, database.AuthEventLoginFailed, "disabled")
+		respondWithError(w, http.StatusForbidden, "Your account is disabled", nil)
 		return
 	}
 
-	refreshToken, err := auth.MakeRefreshToken()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+	cfg.respondWithLogin(w, r, user, "password")
+}
+
+// respondWithLogin logs in a user who has proven who they are using
+// method, or asks for their second factor if they have one.
+func (cfg *apiConfig) respondWithLogin(w http.ResponseWriter, r *http.Request, user database.User, method string) {
+	if user.TOTPEnabledAt != nil {
+		cfg.respondWithMFAChallenge(w, user)
 		return
 	}
+	cfg.respondWithSession(w, r, user, method)
+}
+
+// respondWithSession starts a session for user and responds with its
+// tokens. Failed logins are only forgiven here, once the user has passed
+// every check, so a known password doesn't reset the count of wrong codes.
+func (cfg *apiConfig) respondWithSession(w http.ResponseWriter, r *http.Request, user database.User, method string) {
+	type response struct {
+		database.User
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
-		UserID:    user.ID,
-		Token:     refreshToken,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
-	})
+	accessToken, refreshToken, err := cfg.startSession(r, user)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start session", err)
 		return
 	}
+	if user.FailedLogins > 0 {
+		err = cfg.db.ResetLoginFailures(user.ID)
+		if err != nil {
+			log.Printf("Couldn't reset failed logins for user %s: %v", user.ID, err)
+		}
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventLogin, method)
 
 	respondWithJSON(w, http.StatusOK, response{
 		User:         user,
@@ -76,3 +100,33 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		RefreshToken: refreshToken,
 	})
 }
+
+// startSession logs user in, returning an access token and the refresh
+// token for a new session.
+func (cfg *apiConfig) startSession(r *http.Request, user database.User) (string, string, error) {
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	session, err := cfg.db.CreateSession(database.CreateSessionParams{
+		UserID:        user.ID,
+		RefreshToken:  refreshToken,
+		ExpiresAt:     time.Now().UTC().Add(cfg.refreshTokenTTL),
+		SessionClient: cfg.sessionClient(r),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := auth.MakeJWT(
+		user.ID,
+		session.ID,
+		cfg.jwtKeys,
+		cfg.accessTokenTTL,
+	)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
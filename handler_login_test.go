@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func TestLoginEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		wantCode int
+	}{
+		{name: "exact", email: "boots@example.com", wantCode: http.StatusOK},
+		{name: "surrounding whitespace", email: "  boots@example.com\n", wantCode: http.StatusOK},
+		{name: "display name", email: "Boots <boots@example.com>", wantCode: http.StatusUnauthorized},
+		{name: "not an address", email: "boots", wantCode: http.StatusUnauthorized},
+		{name: "unknown", email: "fish@example.com", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.jwtKeys = auth.NewHMACKeySet("secret")
+			cfg.accessTokenTTL = time.Hour
+			cfg.refreshTokenTTL = time.Hour
+			createTestUser(t, cfg, "boots@example.com", "password")
+
+			body := `{"email": ` + strconv.Quote(tt.email) + `, "password": "password"}`
+			w := httptest.NewRecorder()
+			cfg.handlerLogin(w, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body)))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestLoginLocksOut(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.jwtKeys = auth.NewHMACKeySet("secret")
+	cfg.accessTokenTTL = time.Hour
+	cfg.refreshTokenTTL = time.Hour
+	createTestUser(t, cfg, "boots@example.com", "password")
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"email": "boots@example.com", "password": ` + strconv.Quote(password) + `}`
+		w := httptest.NewRecorder()
+		cfg.handlerLogin(w, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body)))
+		return w
+	}
+
+	for i := 1; i <= loginDelayAfter; i++ {
+		if w := login("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want %d", i, w.Code, http.StatusUnauthorized)
+		}
+	}
+	// The right password is refused without being checked while locked.
+	w := login("password")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked login status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "1" && retry != "2" {
+		t.Errorf("Retry-After = %q, want 1 or 2 seconds", retry)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	totpIssuer = "Tubely"
+	// mfaChallengeTTL is how long a user has to enter their code after
+	// their password.
+	mfaChallengeTTL         = 5 * time.Minute
+	maxMFAChallengeAttempts = 5
+	recoveryCodeCount       = 10
+)
+
+// respondWithMFAChallenge responds to a correct password from a user with
+// TOTP enabled. Instead of tokens they get an MFA token to send to
+// /api/login/mfa along with a code.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user database.User) {
+	type response struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create MFA token", err)
+		return
+	}
+	err = cfg.db.CreateMFAChallenge(user.ID, auth.HashToken(token), time.Now().UTC().Add(mfaChallengeTTL))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save MFA token", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		MFARequired: true,
+		MFAToken:    token,
+	})
+}
+
+// checkSecondFactor reports whether code is a current TOTP code for the
+// user or recoveryCode is one of their unused recovery codes. Either is
+// used up by a successful check.
+func (cfg *apiConfig) checkSecondFactor(userID uuid.UUID, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return cfg.db.UseRecoveryCode(userID, auth.HashRecoveryCode(recoveryCode))
+	}
+
+	totp, err := cfg.db.GetTOTP(userID)
+	if err != nil {
+		return false, err
+	}
+	if totp.EnabledAt == nil {
+		return false, nil
+	}
+	step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return cfg.db.UseTOTPStep(userID, step)
+}
+
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	hash := auth.HashToken(params.MFAToken)
+	challenge, err := cfg.db.GetMFAChallenge(hash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get MFA token", err)
+		return
+	}
+	if challenge.UserID == uuid.Nil || challenge.UsedAt != nil ||
+		!time.Now().Before(challenge.ExpiresAt) || challenge.Attempts >= maxMFAChallengeAttempts {
+		respondWithError(w, http.StatusUnauthorized, "MFA token is invalid or has expired, log in again", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(challenge.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "MFA token is invalid or has expired, log in again", nil)
+		return
+	}
+	if user.DisabledAt != nil {
+		respondWithError(w, http.StatusForbidden, "Your account is disabled", nil)
+		return
+	}
+	if isLocked(*user) {
+		cfg.recordAuthEvent(r, user.ID, database.AuthEventLoginFailed, "locked")
+		respondWithLocked(w, *user)
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(user.ID, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		err = cfg.db.RecordMFAChallengeFailure(hash)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+			return
+		}
+		cfg.recordLoginFailure(r, *user, "mfa")
+		respondWithError(w, http.StatusUnauthorized, "Incorrect code", nil)
+		return
+	}
+
+	ok, err = cfg.db.CompleteMFAChallenge(hash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't use MFA token", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "MFA token is invalid or has expired, log in again", nil)
+		return
+	}
+
+	cfg.respondWithSession(w, r, *user, "mfa")
+}
+
+// handlerTOTPEnroll starts TOTP enrollment with a new secret. It isn't
+// enabled until a code from it is confirmed. The user has to confirm who
+// they are, so a stolen access token can't be used to enroll the thief's
+// authenticator.
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := reauthParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	if !cfg.reauthenticate(w, r, *user, params) {
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create secret", err)
+		return
+	}
+	err = cfg.db.SetPendingTOTP(user.ID, secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save secret", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Secret: secret,
+		URI:    auth.TOTPProvisioningURI(secret, totpIssuer, user.Email),
+	})
+}
+
+// handlerTOTPConfirm enables TOTP once the user proves their authenticator
+// has the secret, and confirms who they are again, and returns their
+// recovery codes. This is the only time the codes are shown.
+func (cfg *apiConfig) handlerTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		reauthParams
+		// Code is from the authenticator being enrolled. There's no
+		// second factor to check yet, so reauthParams' code goes unused.
+		Code string `json:"code"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	totp, err := cfg.db.GetTOTP(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get secret", err)
+		return
+	}
+	if totp.EnabledAt != nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	if totp.Secret == "" {
+		respondWithError(w, http.StatusBadRequest, "Start enrollment first", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if !cfg.reauthenticate(w, r, *user, params.reauthParams) {
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, params.Code, time.Now())
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Incorrect code", nil)
+		return
+	}
+
+	codes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes", err)
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	err = cfg.db.EnableTOTP(p.UserID, step, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication", err)
+		return
+	}
+	cfg.recordAuthEvent(r, p.UserID, database.AuthEventMFAEnabled, "totp")
+
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+// handlerTOTPDisable turns TOTP off. It needs a current code or a recovery
+// code, so a stolen access token alone can't remove the second factor.
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	totp, err := cfg.db.GetTOTP(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get secret", err)
+		return
+	}
+	if totp.EnabledAt == nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication isn't enabled", nil)
+		return
+	}
+	ok, err := cfg.checkSecondFactor(p.UserID, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Incorrect code", nil)
+		return
+	}
+
+	err = cfg.db.DisableTOTP(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication", err)
+		return
+	}
+	cfg.recordAuthEvent(r, p.UserID, database.AuthEventMFADisabled, "totp")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// currentTOTPCode is what an authenticator app shows for secret now.
+func currentTOTPCode(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, time.Now().Unix()/30)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[offset:])&0x7fffffff%1000000)
+}
+
+func TestTOTPEnrollReauthenticates(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		body     string
+		// session is how long ago the user logged in, or zero for no
+		// session.
+		session  time.Duration
+		wantCode int
+	}{
+		{name: "right password", password: "hunter2", body: `{"password": "hunter2"}`, wantCode: http.StatusOK},
+		{name: "wrong password", password: "hunter2", body: `{"password": "guess"}`, wantCode: http.StatusForbidden},
+		{name: "no password", password: "hunter2", body: `{}`, wantCode: http.StatusForbidden},
+		{name: "single sign-on, recent login", body: `{}`, session: time.Second, wantCode: http.StatusOK},
+		{name: "single sign-on, no session", body: `{}`, wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			userID := createTestUser(t, cfg, "boots@example.com", tt.password)
+			sessionID := ""
+			if tt.session != 0 {
+				session, err := cfg.db.CreateSession(database.CreateSessionParams{
+					UserID:       userID,
+					RefreshToken: "refresh",
+					ExpiresAt:    time.Now().Add(time.Hour),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				sessionID = session.ID
+			}
+
+			w := httptest.NewRecorder()
+			cfg.handlerTOTPEnroll(w, newUserRequest(http.MethodPost, "/api/users/me/mfa/totp", tt.body, userID, sessionID))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			totp, err := cfg.db.GetTOTP(userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enrolled := totp.Secret != ""; enrolled != (tt.wantCode == http.StatusOK) {
+				t.Errorf("secret saved = %v", enrolled)
+			}
+		})
+	}
+}
+
+func TestTOTPConfirmReauthenticates(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		// code replaces the authenticator's current code if it's set.
+		code     string
+		wantCode int
+	}{
+		{name: "right password and code", password: "hunter2", wantCode: http.StatusOK},
+		{name: "wrong password", password: "guess", wantCode: http.StatusForbidden},
+		{name: "wrong code", password: "hunter2", code: "000000", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			userID := createTestUser(t, cfg, "boots@example.com", "hunter2")
+
+			w := httptest.NewRecorder()
+			cfg.handlerTOTPEnroll(w, newUserRequest(http.MethodPost, "/api/users/me/mfa/totp", `{"password": "hunter2"}`, userID, ""))
+			if w.Code != http.StatusOK {
+				t.Fatalf("enroll status = %d: %s", w.Code, w.Body)
+			}
+			var enrollment struct {
+				Secret string `json:"secret"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+				t.Fatal(err)
+			}
+
+			code := tt.code
+			if code == "" {
+				code = currentTOTPCode(t, enrollment.Secret)
+			}
+			body := fmt.Sprintf(`{"password": %q, "code": %q}`, tt.password, code)
+			w = httptest.NewRecorder()
+			cfg.handlerTOTPConfirm(w, newUserRequest(http.MethodPost, "/api/users/me/mfa/totp/confirm", body, userID, ""))
+			if w.Code != tt.wantCode {
+				t.Fatalf("confirm status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			totp, err := cfg.db.GetTOTP(userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enabled := totp.EnabledAt != nil; enabled != (tt.wantCode == http.StatusOK) {
+				t.Errorf("enabled = %v", enabled)
+			}
+		})
+	}
+}
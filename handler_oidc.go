@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+)
+
+const (
+	// oidcStateTTL is how long a user has to log in at the provider.
+	oidcStateTTL = 10 * time.Minute
+	// oidcLoginTokenTTL is how long the app has to swap the token it's
+	// redirected back with for a session.
+	oidcLoginTokenTTL = time.Minute
+	// oidcStateCookie holds a hash of the state parameter, tying the
+	// callback to the browser that started the login. Without it, an
+	// attacker could get a victim logged in as the attacker by sending
+	// them the attacker's own callback URL.
+	oidcStateCookie = "oidc_state"
+)
+
+// handlerOIDCLogin starts a single sign-on login by sending the user to
+// the provider.
+func (cfg *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "Single sign-on isn't configured", nil)
+		return
+	}
+
+	ar, err := oidc.NewAuthRequest()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start login", err)
+		return
+	}
+	err = cfg.db.CreateOIDCState(auth.HashToken(ar.State), database.OIDCState{
+		Nonce:        ar.Nonce,
+		CodeVerifier: ar.CodeVerifier,
+		ExpiresAt:    time.Now().UTC().Add(oidcStateTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save login", err)
+		return
+	}
+
+	authURL, err := cfg.oidc.AuthCodeURL(r.Context(), ar)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't reach the single sign-on provider", err)
+		return
+	}
+	// Lax still sends the cookie on the provider's top-level redirect
+	// back to the callback.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    auth.HashToken(ar.State),
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handlerOIDCCallback is where the provider sends the user back. The user
+// is sent on to the app with a short-lived login token rather than their
+// access and refresh tokens, which shouldn't appear in URLs.
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "Single sign-on isn't configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		cfg.redirectToApp(w, r, "oidc_error", "Single sign-on failed: "+providerError, nil)
+		return
+	}
+
+	stateHash := auth.HashToken(query.Get("state"))
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(stateHash)) != 1 {
+		cfg.redirectToApp(w, r, "oidc_error", "Single sign-on was started in another browser, try again", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	state, err := cfg.db.ConsumeOIDCState(stateHash)
+	if err != nil {
+		cfg.redirectToApp(w, r, "oidc_error", "Couldn't finish single sign-on", err)
+		return
+	}
+	if state.Nonce == "" || !time.Now().Before(state.ExpiresAt) {
+		cfg.redirectToApp(w, r, "oidc_error", "Single sign-on expired or was already finished, try again", nil)
+		return
+	}
+
+	claims, err := cfg.oidc.Exchange(r.Context(), query.Get("code"), oidc.AuthRequest{
+		State:        query.Get("state"),
+		Nonce:        state.Nonce,
+		CodeVerifier: state.CodeVerifier,
+	})
+	if err != nil {
+		cfg.redirectToApp(w, r, "oidc_error", "Couldn't finish single sign-on", err)
+		return
+	}
+
+	user, err := cfg.oidcUser(claims)
+	if errors.Is(err, errOIDCAccountUnverified) {
+		cfg.redirectToApp(w, r, "oidc_error", "An account with your email address exists but hasn't verified it. Log in with your password and verify your email address first", nil)
+		return
+	}
+	if err != nil {
+		cfg.redirectToApp(w, r, "oidc_error", "Couldn't finish single sign-on", err)
+		return
+	}
+	if user == nil {
+		cfg.redirectToApp(w, r, "oidc_error", "Your single sign-on account has no verified email address", nil)
+		return
+	}
+	if user.DisabledAt != nil {
+		cfg.redirectToApp(w, r, "oidc_error", "Your account is disabled", nil)
+		return
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		cfg.redirectToApp(w, r, "oidc_error", "Couldn't finish single sign-on", err)
+		return
+	}
+	err = cfg.db.CreateUserToken(database.CreateUserTokenParams{
+		UserID:    user.ID,
+		Purpose:   database.UserTokenOIDCLogin,
+		Email:     user.Email,
+		Hash:      auth.HashToken(token),
+		ExpiresAt: time.Now().UTC().Add(oidcLoginTokenTTL),
+	})
+	if err != nil {
+		cfg.redirectToApp(w, r, "oidc_error", "Couldn't finish single sign-on", err)
+		return
+	}
+
+	cfg.redirectToApp(w, r, "oidc_login", token, nil)
+}
+
+// errOIDCAccountUnverified is returned by oidcUser when the account with
+// the provider's email address hasn't verified it. Whoever signed up may
+// not own the address, and linking would let them keep using the account
+// with their password once the owner starts logging in with the provider.
+var errOIDCAccountUnverified = errors.New("account email address isn't verified")
+
+// oidcUser finds the user the provider logged in, linking the identity to
+// the account with the same email address or creating one the first time
+// it's seen. It returns nil if the provider hasn't verified their email,
+// since anyone could otherwise claim an existing account, and
+// errOIDCAccountUnverified if the account hasn't verified it either.
+func (cfg *apiConfig) oidcUser(claims oidc.Claims) (*database.User, error) {
+	issuer := cfg.oidc.Issuer()
+	user, err := cfg.db.GetUserByIdentity(issuer, claims.Subject)
+	if err != nil || user != nil {
+		return user, err
+	}
+
+	if !claims.EmailVerified {
+		return nil, nil
+	}
+	email, err := normalizeEmail(claims.Email)
+	if err != nil {
+		return nil, nil
+	}
+
+	existing, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if existing.Email == "" {
+		return cfg.db.CreateUserWithIdentity(email, issuer, claims.Subject)
+	}
+	if existing.EmailVerifiedAt == nil {
+		return nil, errOIDCAccountUnverified
+	}
+	err = cfg.db.LinkIdentity(existing.ID, issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.db.GetUser(existing.ID)
+}
+
+// redirectToApp sends the browser back to the app with value in the query
+// parameter param, logging err if there is one.
+func (cfg *apiConfig) redirectToApp(w http.ResponseWriter, r *http.Request, param, value string, err error) {
+	if err != nil {
+		log.Println(value+":", err)
+	}
+	http.Redirect(w, r, cfg.baseURL+"/app/?"+url.Values{param: {value}}.Encode(), http.StatusFound)
+}
+
+// handlerLoginOIDC swaps the login token from handlerOIDCCallback for a
+// session, like logging in with a password. Users with two-factor
+// authentication get an MFA challenge instead, since the provider only
+// vouches for the first factor.
+func (cfg *apiConfig) handlerLoginOIDC(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := cfg.db.UseOIDCLoginToken(auth.HashToken(params.Token))
+	if errors.Is(err, database.ErrUserTokenInvalid) {
+		respondWithError(w, http.StatusUnauthorized, "Login token is invalid or has expired", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't use login token", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "Login token is invalid or has expired", nil)
+		return
+	}
+	if user.DisabledAt != nil {
+		respondWithError(w, http.StatusForbidden, "Your account is disabled", nil)
+		return
+	}
+
+	cfg.respondWithLogin(w, r, *user, "oidc")
+}
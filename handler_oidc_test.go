@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func newOIDCTestConfig(t *testing.T) (*apiConfig, *oidctest.Provider) {
+	t.Helper()
+	idp := oidctest.NewProvider(t, "tubely")
+	cfg := newTestConfig(t)
+	cfg.oidc = oidc.NewProvider(idp.Issuer(), "tubely", "", cfg.baseURL+"/api/oidc/callback")
+	return cfg, idp
+}
+
+// startOIDCLogin starts a login and returns where the browser is sent and
+// the state cookie it's given.
+func startOIDCLogin(t *testing.T, cfg *apiConfig) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	cfg.handlerOIDCLogin(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d: %s", w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+				t.Errorf("state cookie isn't HttpOnly and SameSite=Lax: %+v", cookie)
+			}
+			return w.Header().Get("Location"), cookie
+		}
+	}
+	t.Fatal("login didn't set a state cookie")
+	return "", nil
+}
+
+// finishOIDCLogin sends the browser back to the callback and returns the
+// query the app is redirected to with.
+func finishOIDCLogin(t *testing.T, cfg *apiConfig, callback url.Values, cookie *http.Cookie) url.Values {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+callback.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	cfg.handlerOIDCCallback(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback status = %d: %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), cfg.baseURL+"/app/") {
+		t.Fatalf("callback redirected to %s, not the app", location)
+	}
+	return location.Query()
+}
+
+// createVerifiedTestUser creates a user with password whose email address
+// is verified.
+func createVerifiedTestUser(t *testing.T, cfg *apiConfig, email, password string) uuid.UUID {
+	t.Helper()
+	id := createTestUser(t, cfg, email, password)
+	err := cfg.db.CreateUserToken(database.CreateUserTokenParams{
+		UserID:    id,
+		Purpose:   database.UserTokenVerifyEmail,
+		Email:     email,
+		Hash:      "verify-" + id.String(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.VerifyEmail("verify-" + id.String()); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestOIDCCallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, cfg *apiConfig) uuid.UUID
+		user  oidctest.Login
+		// cookie returns the cookie the browser sends back.
+		cookie    func(t *testing.T, cfg *apiConfig, own *http.Cookie) *http.Cookie
+		wantError string
+		// wantUser is whether the login is for the user setup returned.
+		wantUser bool
+	}{
+		{
+			name: "new user",
+			user: oidctest.Login{Subject: "sub-1", Email: " Boots@Example.com ", EmailVerified: true},
+		},
+		{
+			name: "links an account with the same email",
+			setup: func(t *testing.T, cfg *apiConfig) uuid.UUID {
+				return createVerifiedTestUser(t, cfg, "boots@example.com", "password")
+			},
+			user:     oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+			wantUser: true,
+		},
+		{
+			name: "account that hasn't verified its email doesn't link",
+			setup: func(t *testing.T, cfg *apiConfig) uuid.UUID {
+				return createTestUser(t, cfg, "boots@example.com", "attacker's password")
+			},
+			user:      oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+			wantError: "hasn't verified it",
+		},
+		{
+			name: "returning user whose email changed",
+			setup: func(t *testing.T, cfg *apiConfig) uuid.UUID {
+				id := createVerifiedTestUser(t, cfg, "boots@example.com", "password")
+				if err := cfg.db.LinkIdentity(id, cfg.oidc.Issuer(), "sub-1"); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			user:     oidctest.Login{Subject: "sub-1", Email: "boots@elsewhere.example.com"},
+			wantUser: true,
+		},
+		{
+			name: "unverified email doesn't link",
+			setup: func(t *testing.T, cfg *apiConfig) uuid.UUID {
+				return createTestUser(t, cfg, "boots@example.com", "password")
+			},
+			user:      oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: false},
+			wantError: "no verified email",
+		},
+		{
+			name:      "nonce mismatch",
+			user:      oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true, Claims: jwt.MapClaims{"nonce": "other"}},
+			wantError: "Couldn't finish",
+		},
+		{
+			name: "disabled user",
+			setup: func(t *testing.T, cfg *apiConfig) uuid.UUID {
+				id := createVerifiedTestUser(t, cfg, "boots@example.com", "password")
+				if err := cfg.db.DisableUser(id); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			user:      oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+			wantError: "disabled",
+		},
+		{
+			name: "no state cookie",
+			user: oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+			cookie: func(t *testing.T, cfg *apiConfig, own *http.Cookie) *http.Cookie {
+				return nil
+			},
+			wantError: "another browser",
+		},
+		{
+			name: "state cookie from another login",
+			user: oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+			cookie: func(t *testing.T, cfg *apiConfig, own *http.Cookie) *http.Cookie {
+				_, cookie := startOIDCLogin(t, cfg)
+				return cookie
+			},
+			wantError: "another browser",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, idp := newOIDCTestConfig(t)
+			var existing uuid.UUID
+			if tt.setup != nil {
+				existing = tt.setup(t, cfg)
+			}
+
+			authURL, cookie := startOIDCLogin(t, cfg)
+			callback, err := idp.Authorize(authURL, tt.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.cookie != nil {
+				cookie = tt.cookie(t, cfg, cookie)
+			}
+			app := finishOIDCLogin(t, cfg, callback, cookie)
+
+			if tt.wantError != "" {
+				if !strings.Contains(app.Get("oidc_error"), tt.wantError) {
+					t.Fatalf("app query = %v, want an oidc_error containing %q", app, tt.wantError)
+				}
+				user, err := cfg.db.GetUserByIdentity(cfg.oidc.Issuer(), tt.user.Subject)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user != nil && user.ID != existing {
+					t.Errorf("a failed login linked the identity to %s", user.ID)
+				}
+				return
+			}
+
+			userID, err := cfg.db.UseOIDCLoginToken(auth.HashToken(app.Get("oidc_login")))
+			if err != nil {
+				t.Fatalf("app query = %v: %v", app, err)
+			}
+			if tt.wantUser && userID != existing {
+				t.Errorf("logged in as %s, want %s", userID, existing)
+			}
+			if !tt.wantUser && userID == existing {
+				t.Errorf("logged in as the existing user")
+			}
+			user, err := cfg.db.GetUserByIdentity(cfg.oidc.Issuer(), tt.user.Subject)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user == nil || user.ID != userID {
+				t.Fatalf("identity is linked to %v, want %s", user, userID)
+			}
+			if user.EmailVerifiedAt == nil {
+				t.Error("email isn't marked verified")
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackReplay(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+	authURL, cookie := startOIDCLogin(t, cfg)
+	callback, err := idp.Authorize(authURL, oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app := finishOIDCLogin(t, cfg, callback, cookie); app.Get("oidc_login") == "" {
+		t.Fatalf("first callback failed: %v", app)
+	}
+	if app := finishOIDCLogin(t, cfg, callback, cookie); app.Get("oidc_error") == "" {
+		t.Fatalf("replayed callback logged in: %v", app)
+	}
+}
+
+func TestLoginOIDCRequiresMFA(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+	cfg.jwtKeys = auth.NewHMACKeySet("secret")
+	cfg.accessTokenTTL = time.Hour
+	cfg.refreshTokenTTL = time.Hour
+	userID := createVerifiedTestUser(t, cfg, "boots@example.com", "password")
+	if err := cfg.db.SetPendingTOTP(userID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.EnableTOTP(userID, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, cookie := startOIDCLogin(t, cfg)
+	callback, err := idp.Authorize(authURL, oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := finishOIDCLogin(t, cfg, callback, cookie)
+	if app.Get("oidc_login") == "" {
+		t.Fatalf("callback failed: %v", app)
+	}
+
+	body := `{"token": "` + app.Get("oidc_login") + `"}`
+	w := httptest.NewRecorder()
+	cfg.handlerLoginOIDC(w, httptest.NewRequest(http.MethodPost, "/api/login/oidc", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		MFARequired bool   `json:"mfa_required"`
+		Token       string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.MFARequired || resp.Token != "" {
+		t.Errorf("response = %+v, want an MFA challenge and no access token", resp)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+	// Avatars don't count towards quotas, so their size is limited
+	// instead.
+	maxAvatarSize = 2 << 20
+)
+
+func (cfg *apiConfig) handlerUsersMeGet(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// handlerUsersMeUpdate changes the profile fields that are set. A new email
+// address needs the same confirmation as deleting the account, and only
+// replaces the current one once the user follows the link sent to it.
+func (cfg *apiConfig) handlerUsersMeUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		Email       *string `json:"email"`
+		reauthParams
+	}
+	type response struct {
+		database.User
+		EmailChangePending bool `json:"email_change_pending"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.DisplayName != nil {
+		displayName := strings.TrimSpace(*params.DisplayName)
+		if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Display name can't be longer than %d characters", maxDisplayNameLength), nil)
+			return
+		}
+		params.DisplayName = &displayName
+	}
+	if params.Bio != nil && utf8.RuneCountInString(*params.Bio) > maxBioLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bio can't be longer than %d characters", maxBioLength), nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	newEmail := ""
+	if params.Email != nil {
+		email, err := normalizeEmail(*params.Email)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Email must be a valid email address", err)
+			return
+		}
+		if email != user.Email {
+			newEmail = email
+		}
+	}
+	if newEmail != "" {
+		if !cfg.reauthenticate(w, r, *user, params.reauthParams) {
+			return
+		}
+		existing, err := cfg.db.GetUserByEmail(newEmail)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't change email", err)
+			return
+		}
+		if existing.Email != "" {
+			respondWithError(w, http.StatusConflict, "An account with that email already exists", nil)
+			return
+		}
+	}
+
+	err = cfg.db.UpdateUserProfile(user.ID, database.UpdateUserProfileParams{
+		DisplayName: params.DisplayName,
+		Bio:         params.Bio,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update profile", err)
+		return
+	}
+
+	if newEmail != "" {
+		err = cfg.sendUserToken(user.ID, newEmail, database.UserTokenChangeEmail)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't send confirmation email", err)
+			return
+		}
+		// Let the current address know, in case it wasn't them.
+		go cfg.sendMail(mailer.Message{
+			To:      user.Email,
+			Subject: "Your Tubely email address is changing",
+			Body:    fmt.Sprintf("Someone asked to change your Tubely account's email address to %s. It won't change until they follow the link sent there.\n\nIf this wasn't you, change your password.", newEmail),
+		})
+	}
+
+	user, err = cfg.db.GetUser(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		User:               *user,
+		EmailChangePending: newEmail != "",
+	})
+}
+
+// handlerAvatarUpload sets the user's avatar. It's stored like a
+// thumbnail, named after its content, so identical images share one file.
+func (cfg *apiConfig) handlerAvatarUpload(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	// Leave room for the rest of the form.
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1<<20)
+	image, ok := readImage(w, r, "avatar", maxAvatarSize, nil)
+	if !ok {
+		return
+	}
+
+	upload, err := cfg.stageImage(database.CreateUploadParams{UserID: p.UserID}, image)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save avatar", err)
+		return
+	}
+	released, err := cfg.db.CommitAvatarUpload(upload, cfg.getAssetURL(image.key))
+	if err != nil {
+		cfg.abortUpload(upload)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set avatar", err)
+		return
+	}
+	cfg.releaseReplacedAssets(released)
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+func (cfg *apiConfig) handlerAvatarDelete(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	released, err := cfg.db.SetUserAvatar(p.UserID, "", "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove avatar", err)
+		return
+	}
+	cfg.releaseReplacedAssets(released)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPasswordChange sets a new password once the user confirms who
+// they are. Every other session is logged out, so whoever knew the old
+// password loses access, but the one making the change stays logged in.
+func (cfg *apiConfig) handlerPasswordChange(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		reauthParams
+		NewPassword string `json:"new_password"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "New password is required", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if !cfg.reauthenticate(w, r, *user, params.reauthParams) {
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.NewPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+	err = cfg.db.ChangePassword(user.ID, hashedPassword, p.SessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't change password", err)
+		return
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventPasswordChange, "change")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
+// handlerRefresh exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once; presenting one again logs
+// out every session descended from the same login.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,24 +24,49 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	newRefreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+
+	rt, err := cfg.db.RotateRefreshToken(
+		refreshToken,
+		newRefreshToken,
+		time.Now().UTC().Add(cfg.refreshTokenTTL),
+		cfg.sessionClient(r),
+	)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		if reused, err := cfg.db.GetRefreshToken(refreshToken); err == nil {
+			cfg.recordAuthEvent(r, reused.UserID, database.AuthEventRefreshReused, "")
+		}
+		respondWithError(w, http.StatusUnauthorized, "Refresh token was already used, log in again", err)
+		return
+	}
+	if errors.Is(err, database.ErrRefreshTokenInvalid) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is expired or revoked", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't rotate refresh token", err)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour,
+		rt.UserID,
+		rt.FamilyID,
+		cfg.jwtKeys,
+		cfg.accessTokenTTL,
 	)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
 		return
 	}
+	cfg.recordAuthEvent(r, rt.UserID, database.AuthEventRefresh, "")
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: rt.Token,
 	})
 }
 
@@ -46,11 +77,20 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rt, err := cfg.db.GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get session", err)
+		return
+	}
+
 	err = cfg.db.RevokeRefreshToken(refreshToken)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
 	}
+	if rt.Token != "" {
+		cfg.recordAuthEvent(r, rt.UserID, database.AuthEventRevoke, "logout")
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// sessionClient describes the client making a request, for recording
+// against its session.
+func (cfg *apiConfig) sessionClient(r *http.Request) database.SessionClient {
+	return database.SessionClient{
+		UserAgent: r.UserAgent(),
+		IP:        cfg.clientIP(r),
+	}
+}
+
+func (cfg *apiConfig) handlerSessionsGet(w http.ResponseWriter, r *http.Request) {
+	type session struct {
+		database.Session
+		Current bool `json:"current"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	sessions, err := cfg.db.GetSessions(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve sessions", err)
+		return
+	}
+
+	response := make([]session, len(sessions))
+	for i, s := range sessions {
+		response[i] = session{
+			Session: s,
+			Current: s.ID == p.SessionID,
+		}
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handlerSessionRevoke logs out of one session. Access tokens already
+// issued for it stop working too.
+func (cfg *apiConfig) handlerSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	session, err := cfg.db.GetSession(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get session", err)
+		return
+	}
+	if session.ID == "" || session.UserID != p.UserID {
+		respondWithError(w, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+
+	err = cfg.db.RevokeSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
+		return
+	}
+	cfg.recordAuthEvent(r, p.UserID, database.AuthEventRevoke, "session")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerSessionsRevokeAll logs the user out everywhere, including the
+// session making the request.
+func (cfg *apiConfig) handlerSessionsRevokeAll(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	err := cfg.db.RevokeUserSessions(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	cfg.recordAuthEvent(r, p.UserID, database.AuthEventRevoke, "all_sessions")
+
+	w.WriteHeader(http.StatusNoContent)
+}
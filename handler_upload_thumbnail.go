@@ -1,16 +1,16 @@
 package main
 
 import (
-	"fmt"
-	"io"
-	"mime"
+	"errors"
 	"net/http"
-	"os"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// maxThumbnailSize is the largest thumbnail accepted.
+const maxThumbnailSize = 10 << 20
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -19,72 +19,63 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	p, _ := requestPrincipal(r)
+
+	v, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Could't find video", err)
 		return
 	}
-
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	if v.ID == uuid.Nil || v.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Could't find video", nil)
 		return
 	}
-
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	const maxMemory = 10 << 20
-	r.ParseMultipartForm(maxMemory)
-
-	file, header, err := r.FormFile("thumbnail")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+	if !authorizeOwner(w, p, v.UserID) {
 		return
 	}
-	defer file.Close()
 
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	digest, err := parseUploadDigest(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Could't parse mediatype", nil)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file format for thumbnail", nil)
+
+	image, ok := readImage(w, r, "thumbnail", maxThumbnailSize, digest)
+	if !ok {
 		return
 	}
 
-	assetPath := getAssetPath(mediaType)
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
-
-	dst, err := os.Create(assetDiskPath)
+	replacedBytes, err := cfg.db.GetCommittedBytes(videoID, database.UploadKindThumbnail)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could't create file on the server", nil)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check quota", err)
 		return
 	}
-	defer dst.Close()
-	if _, err = io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+	if err := cfg.checkUploadQuota(p.UserID, int64(len(image.data)), replacedBytes); err != nil {
+		respondWithQuotaError(w, http.StatusRequestEntityTooLarge, err)
 		return
 	}
 
-	v, err := cfg.db.GetVideo(videoID)
+	upload, err := cfg.stageImage(database.CreateUploadParams{VideoID: videoID}, image)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could't find video", err)
-		return
-	}
-	if userID != v.UserID {
-		respondWithError(w, http.StatusUnauthorized, "You're not an owner of this video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
 		return
 	}
 
-	url := cfg.getAssetURL(assetPath)
+	url := cfg.getAssetURL(image.key)
 	v.ThumbnailURL = &url
+	v.ThumbnailSHA256 = &image.checksum
 
-	err = cfg.db.UpdateVideo(v)
+	v, replaced, err := cfg.db.CommitUpload(upload, v)
 	if err != nil {
+		cfg.abortUpload(upload)
+		if errors.Is(err, database.ErrVideoVersionConflict) {
+			respondWithError(w, http.StatusConflict, "Video was modified by another request, try again", err)
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, "Could't update video thumbnail", err)
 		return
 	}
+	cfg.releaseReplacedAssets(replaced)
 
-	respondWithJSON(w, http.StatusOK, v)
+	cfg.respondWithVideo(w, http.StatusOK, v)
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,10 +14,11 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -28,28 +32,41 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	p, _ := requestPrincipal(r)
+
+	fmt.Println("uploading video", videoID, "by user", p.UserID)
+
+	v, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Could't find video", err)
+		return
+	}
+	if v.ID == uuid.Nil || v.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Could't find video", nil)
+		return
+	}
+	if !authorizeOwner(w, p, v.UserID) {
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	digest, err := parseUploadDigest(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	fmt.Println("uploading video", videoID, "by user", userID)
-
-	v, err := cfg.db.GetVideo(videoID)
+	// Reject uploads that can't possibly fit before reading them; the exact
+	// size is checked again once the video is processed.
+	replacedBytes, err := cfg.db.GetCommittedBytes(videoID, database.UploadKindVideo)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could't find video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check quota", err)
 		return
 	}
-	if userID != v.UserID {
-		respondWithError(w, http.StatusUnauthorized, "You're not an owner of this video", err)
-		return
+	if r.ContentLength > 0 {
+		if err := cfg.checkUploadQuota(p.UserID, r.ContentLength, replacedBytes); err != nil {
+			respondWithQuotaError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
 	}
 
 	file, header, err := r.FormFile("video")
@@ -77,10 +94,20 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
-	if _, err := io.Copy(tempFile, file); err != nil {
+	var dst io.Writer = tempFile
+	if digest != nil {
+		dst = io.MultiWriter(tempFile, digest)
+	}
+	if _, err := io.Copy(dst, file); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error copying to temporary file", err)
 		return
 	}
+	if digest != nil {
+		if err := digest.Verify(); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Video doesn't match the digest sent", err)
+			return
+		}
+	}
 
 	_, err = tempFile.Seek(0, io.SeekStart)
 	if err != nil {
@@ -94,6 +121,12 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	duration, err := getVideoDuration(tempFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could't get the duration of the video", err)
+		return
+	}
+
 	directory := ""
 	if ratio == "16:9" {
 		directory = "landscape"
@@ -103,9 +136,6 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		directory = "other"
 	}
 
-	key := getAssetPath(mediaType)
-	key = path.Join(directory, key)
-
 	processedFilePath, err := processVideoForFastStart(tempFile.Name())
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Could't process the video for fast start", err)
@@ -120,28 +150,81 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	}
 	defer processedFile.Close()
 
-	input := s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(key),
-		Body:        processedFile,
-		ContentType: aws.String(mediaType),
+	hash := sha256.New()
+	size, err := io.Copy(hash, processedFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could't hash processed video file", err)
+		return
+	}
+	if _, err := processedFile.Seek(0, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could't reset processed file's pointer", err)
+		return
+	}
+	if err := cfg.checkUploadQuota(p.UserID, size, replacedBytes); err != nil {
+		respondWithQuotaError(w, http.StatusRequestEntityTooLarge, err)
+		return
 	}
-	_, err = cfg.s3Client.PutObject(r.Context(), &input)
+
+	sum := hash.Sum(nil)
+	checksum := hex.EncodeToString(sum)
+	key := path.Join(directory, getAssetPath(sum, mediaType))
+
+	upload, needsWrite, err := cfg.stageUpload(database.CreateUploadParams{
+		VideoID: videoID,
+		Kind:    database.UploadKindVideo,
+		Key:     key,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could't upload the video to S3", err)
+		respondWithError(w, http.StatusInternalServerError, "Could't record upload", err)
 		return
 	}
 
-	url := cfg.getVideoURL(key)
-	v.VideoURL = &url
+	if needsWrite {
+		// S3 rejects the object if what it received doesn't match.
+		input := s3.PutObjectInput{
+			Bucket:         aws.String(cfg.s3Bucket),
+			Key:            aws.String(key),
+			Body:           processedFile,
+			ContentType:    aws.String(mediaType),
+			ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(sum)),
+		}
+		_, err = cfg.s3Client.PutObject(r.Context(), &input)
+		if err != nil {
+			cfg.abortUpload(upload)
+			respondWithError(w, http.StatusInternalServerError, "Could't upload the video to S3", err)
+			return
+		}
+		_, err = cfg.db.CreateAsset(database.CreateAssetParams{
+			Kind:      database.UploadKindVideo,
+			Key:       key,
+			SHA256:    checksum,
+			Size:      size,
+			MediaType: mediaType,
+		})
+		if err != nil {
+			cfg.abortUpload(upload)
+			respondWithError(w, http.StatusInternalServerError, "Could't record asset", err)
+			return
+		}
+	}
+
+	v.VideoURL = &key
+	v.VideoSHA256 = &checksum
+	v.Duration = duration
 
-	err = cfg.db.UpdateVideo(v)
+	v, replaced, err := cfg.db.CommitUpload(upload, v)
 	if err != nil {
+		cfg.abortUpload(upload)
+		if errors.Is(err, database.ErrVideoVersionConflict) {
+			respondWithError(w, http.StatusConflict, "Video was modified by another request, try again", err)
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, "Could't update video", err)
 		return
 	}
+	cfg.releaseReplacedAssets(replaced)
 
-	respondWithJSON(w, http.StatusOK, v)
+	cfg.respondWithVideo(w, http.StatusOK, v)
 }
 
 func processVideoForFastStart(filePath string) (string, error) {
@@ -202,3 +285,34 @@ func getVideoAspectRatio(filePath string) (string, error) {
 	}
 	return "other", nil
 }
+
+func getVideoDuration(filePath string) (float64, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", filePath)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	err := cmd.Run()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to run the command: %v", err)
+	}
+
+	var cmdOutput struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+
+	err = json.Unmarshal(output.Bytes(), &cmdOutput)
+	if err != nil {
+		return 0, fmt.Errorf("error unmarshaling the cmd output: %v", err)
+	}
+	if cmdOutput.Format.Duration == "" {
+		return 0, nil
+	}
+
+	duration, err := strconv.ParseFloat(cmdOutput.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %v", cmdOutput.Format.Duration, err)
+	}
+	return duration, nil
+}
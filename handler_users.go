@@ -2,12 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
 )
 
+// handlerUsersCreate signs up a new user. It answers the same way whether
+// or not the email address already has an account, so that signing up can't
+// be used to find out who has one; the owner of an existing account is
+// emailed instead.
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
@@ -26,13 +33,35 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
 		return
 	}
+	params.Email, err = normalizeEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Email must be a valid email address", err)
+		return
+	}
 
+	// Hash before looking the address up, so that both outcomes take about
+	// as long.
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
 		return
 	}
 
+	existing, err := cfg.db.GetUserByEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
+		return
+	}
+	if existing.Email != "" {
+		go cfg.sendMail(mailer.Message{
+			To:      existing.Email,
+			Subject: "You already have a Tubely account",
+			Body:    fmt.Sprintf("Someone tried to sign up for Tubely with this email address, which already has an account. If it was you, log in instead, or reset your password at %s/app/.\n\nIf it wasn't you, you can ignore this email.", cfg.baseURL),
+		})
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
 	user, err := cfg.db.CreateUser(database.CreateUserParams{
 		Email:    params.Email,
 		Password: hashedPassword,
@@ -42,5 +71,71 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, user)
+	// The account works without verifying, so a failure here shouldn't
+	// fail signup. The user can ask for another email.
+	err = cfg.sendUserToken(user.ID, user.Email, database.UserTokenVerifyEmail)
+	if err != nil {
+		log.Printf("Couldn't send verification email to user %s: %v", user.ID, err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerUsersDelete deletes the user's account once they confirm who they
+// are. They're logged out and their videos hidden straight away, and the
+// rest is deleted in the background by runUserDeleter.
+func (cfg *apiConfig) handlerUsersDelete(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := reauthParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if !cfg.reauthenticate(w, r, *user, params) {
+		return
+	}
+
+	err = cfg.db.ScheduleUserDeletion(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete account", err)
+		return
+	}
+	cfg.recordAuthEvent(r, user.ID, database.AuthEventDeletionRequested, "")
+	cfg.wakeUserDeleter()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerUsageGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Usage database.Usage `json:"usage"`
+		Quota userQuota      `json:"quota"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	usage, err := cfg.db.GetUsage(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+	quota, err := cfg.getUserQuota(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get quota", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Usage: usage,
+		Quota: quota,
+	})
 }
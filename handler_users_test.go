@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+)
+
+// chanMailer hands every message it's given to the test.
+type chanMailer chan mailer.Message
+
+func (m chanMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+func (m chanMailer) receive(t *testing.T) mailer.Message {
+	t.Helper()
+	select {
+	case msg := <-m:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return mailer.Message{}
+	}
+}
+
+func TestUsersCreateExistingEmail(t *testing.T) {
+	cfg := newTestConfig(t)
+	mail := make(chanMailer, 1)
+	cfg.mailer = mail
+
+	signup := func(email, password string) *httptest.ResponseRecorder {
+		body := `{"email": "` + email + `", "password": "` + password + `"}`
+		w := httptest.NewRecorder()
+		cfg.handlerUsersCreate(w, httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(body)))
+		return w
+	}
+
+	first := signup("boots@example.com", "password")
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("status = %d: %s", first.Code, first.Body)
+	}
+	if msg := mail.receive(t); msg.To != "boots@example.com" || !strings.Contains(msg.Subject, "Verify") {
+		t.Errorf("sent %q to %s, want a verification email", msg.Subject, msg.To)
+	}
+
+	// Signing up again, in another case, must look the same to the client
+	// and leave the account alone.
+	second := signup("Boots@Example.COM", "hunter2")
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("second signup = %d %q, want %d %q like the first", second.Code, second.Body, first.Code, first.Body)
+	}
+	if msg := mail.receive(t); msg.To != "boots@example.com" || msg.Subject != "You already have a Tubely account" {
+		t.Errorf("sent %q to %s, want a notice to the account's owner", msg.Subject, msg.To)
+	}
+
+	user, err := cfg.db.GetUserByEmail("boots@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Password == "" {
+		t.Fatal("user wasn't created")
+	}
+	if user.Email != "boots@example.com" {
+		t.Errorf("email = %q, want it lowercased", user.Email)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func (cfg *apiConfig) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	_, err = cfg.db.VerifyEmail(auth.HashToken(params.Token))
+	if errors.Is(err, database.ErrUserTokenInvalid) {
+		respondWithError(w, http.StatusBadRequest, "Verification link is invalid or has expired", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerVerifyEmailResend sends the user another verification email.
+func (cfg *apiConfig) handlerVerifyEmailResend(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		respondWithError(w, http.StatusConflict, "Email is already verified", nil)
+		return
+	}
+
+	err = cfg.sendUserToken(user.ID, user.Email, database.UserTokenVerifyEmail)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerEmailChangeConfirm changes the user's email address to the one the
+// confirmation link was sent to.
+func (cfg *apiConfig) handlerEmailChangeConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := cfg.db.ChangeEmail(auth.HashToken(params.Token))
+	if errors.Is(err, database.ErrUserTokenInvalid) {
+		respondWithError(w, http.StatusBadRequest, "Confirmation link is invalid or has expired", err)
+		return
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithError(w, http.StatusConflict, "An account with that email already exists", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't change email", err)
+		return
+	}
+	cfg.recordAuthEvent(r, userID, database.AuthEventEmailChange, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
@@ -14,25 +19,34 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		database.CreateVideoParams
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	p, _ := requestPrincipal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	params.UserID = p.UserID
+
+	params.Title = strings.TrimSpace(params.Title)
+	if err := validateVideoMeta(params.Title, params.Description); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPrivate
+	}
+	if !params.Visibility.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Visibility must be one of private, unlisted, public", nil)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+	if err := cfg.checkVideoQuota(p.UserID); err != nil {
+		respondWithQuotaError(w, http.StatusForbidden, err)
 		return
 	}
-	params.UserID = userID
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
@@ -43,7 +57,10 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
-func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
+// handlerVideoMetaUpdate applies a JSON merge patch (RFC 7396) to a video's
+// editable fields. Clients must send the ETag they last saw in If-Match so
+// that concurrent edits are rejected instead of silently overwritten.
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -51,28 +68,119 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	p, _ := requestPrincipal(r)
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/merge-patch+json" && contentType != "application/json" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/merge-patch+json", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !authorizeOwner(w, p, video.UserID) {
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		respondWithError(w, http.StatusPreconditionRequired, "If-Match is required", nil)
+		return
+	}
+	if !etagMatches(ifMatch, videoETag(video)) {
+		respondWithError(w, http.StatusPreconditionFailed, "Video has changed since it was last fetched", nil)
+		return
+	}
+
+	patch := map[string]json.RawMessage{}
+	err = json.NewDecoder(r.Body).Decode(&patch)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusBadRequest, "Body must be a JSON object", err)
 		return
 	}
 
+	for field, value := range patch {
+		switch field {
+		case "title":
+			var title *string
+			if err := json.Unmarshal(value, &title); err != nil || title == nil {
+				respondWithError(w, http.StatusBadRequest, "title must be a string", err)
+				return
+			}
+			video.Title = strings.TrimSpace(*title)
+		case "description":
+			var description *string
+			if err := json.Unmarshal(value, &description); err != nil {
+				respondWithError(w, http.StatusBadRequest, "description must be a string or null", err)
+				return
+			}
+			video.Description = ""
+			if description != nil {
+				video.Description = *description
+			}
+		case "visibility":
+			var visibility database.Visibility
+			if err := json.Unmarshal(value, &visibility); err != nil || !visibility.Valid() {
+				respondWithError(w, http.StatusBadRequest, "Visibility must be one of private, unlisted, public", err)
+				return
+			}
+			video.Visibility = visibility
+		default:
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Field %q can't be changed", field), nil)
+			return
+		}
+	}
+
+	if err := validateVideoMeta(video.Title, video.Description); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	video, err = cfg.db.UpdateVideo(video)
+	if errors.Is(err, database.ErrVideoVersionConflict) {
+		respondWithError(w, http.StatusPreconditionFailed, "Video has changed since it was last fetched", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	w.Header().Set("ETag", videoETag(video))
+	cfg.respondWithVideo(w, http.StatusOK, video)
+}
+
+func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	p, _ := requestPrincipal(r)
+
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+	if !authorizeOwner(w, p, video.UserID) {
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.TrashVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -89,32 +197,117 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Anonymous viewers have a zero principal, which owns nothing.
+	viewer, _ := requestPrincipal(r)
+
 	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
+	if err != nil || video.ID == uuid.Nil || video.DeletedAt != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	// Private videos are reported as missing rather than forbidden so
+	// their IDs can't be probed.
+	if !canViewVideo(video, viewer.UserID) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	w.Header().Set("ETag", videoETag(video))
+	cfg.respondWithVideo(w, http.StatusOK, video)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+	p, _ := requestPrincipal(r)
+
+	cfg.listVideos(w, r, database.GetVideosParams{
+		UserID: p.UserID,
+	})
+}
+
+func (cfg *apiConfig) handlerVideosPublic(w http.ResponseWriter, r *http.Request) {
+	cfg.listVideos(w, r, database.GetVideosParams{
+		Visibility: database.VisibilityPublic,
+	})
+}
+
+// listVideos responds with one page of the videos selected by params, taking
+// the sort, limit and cursor from the query string.
+func (cfg *apiConfig) listVideos(w http.ResponseWriter, r *http.Request, params database.GetVideosParams) {
+	var err error
+	query := r.URL.Query()
+	params.Sort = database.VideoSort(query.Get("sort"))
+	params.Cursor = query.Get("cursor")
+	if params.Sort != "" && !params.Sort.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Invalid sort, must be one of created_at, updated_at, title, duration", nil)
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		params.Limit, err = strconv.Atoi(limit)
+		if err != nil || params.Limit < 1 || params.Limit > database.MaxVideoPageLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", database.MaxVideoPageLimit), err)
+			return
+		}
+	}
+
+	page, err := cfg.db.GetVideos(params)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	page.Videos, err = cfg.dbVideosToSignedVideos(page.Videos)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+func canViewVideo(video database.Video, viewerID uuid.UUID) bool {
+	if video.UserID == viewerID {
+		return true
+	}
+	return video.Visibility == database.VisibilityUnlisted || video.Visibility == database.VisibilityPublic
+}
+
+const (
+	maxVideoTitleLength       = 200
+	maxVideoDescriptionLength = 5000
+)
+
+func validateVideoMeta(title, description string) error {
+	if title == "" {
+		return errors.New("Title can't be empty")
+	}
+	if utf8.RuneCountInString(title) > maxVideoTitleLength {
+		return fmt.Errorf("Title can't be longer than %d characters", maxVideoTitleLength)
+	}
+	if utf8.RuneCountInString(description) > maxVideoDescriptionLength {
+		return fmt.Errorf("Description can't be longer than %d characters", maxVideoDescriptionLength)
+	}
+	return nil
+}
+
+// videoETag is the entity tag for a video. The row version is bumped on
+// every write, so the tag changes whenever the video does.
+func videoETag(video database.Video) string {
+	return fmt.Sprintf(`"%d"`, video.Version)
+}
+
+// etagMatches implements the If-Match check: the header is either "*" or a
+// comma-separated list of entity tags. If-Match uses the strong comparison
+// (RFC 9110, section 13.1.1), so weak tags never match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (candidate == etag && !strings.HasPrefix(candidate, "W/")) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"3"`, true},
+		{`*`, true},
+		{`"1", "3"`, true},
+		{`W/"3"`, false},
+		{`"1", W/"3"`, false},
+		{`"2"`, false},
+		{`"30"`, false},
+		{`3`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, `"3"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestVideoMetaUpdateIfMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// ifMatch returns the If-Match header to send, given the ETag the
+		// video was fetched with.
+		ifMatch  func(etag string) string
+		wantCode int
+	}{
+		{name: "ETag from GET", ifMatch: func(etag string) string { return etag }, wantCode: http.StatusOK},
+		{name: "weak form", ifMatch: func(etag string) string { return "W/" + etag }, wantCode: http.StatusPreconditionFailed},
+		{name: "no If-Match", ifMatch: func(string) string { return "" }, wantCode: http.StatusPreconditionRequired},
+		{name: "stale", ifMatch: func(string) string { return `"0"` }, wantCode: http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			userID := createTestUser(t, cfg, "boots@example.com", "password")
+			video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: userID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := newUserRequest(http.MethodGet, "/api/videos/"+video.ID.String(), "", userID, "")
+			r.SetPathValue("videoID", video.ID.String())
+			w := httptest.NewRecorder()
+			cfg.handlerVideoGet(w, r)
+			etag := w.Header().Get("ETag")
+			if w.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+				t.Fatalf("GET status = %d, ETag = %q, want a strong ETag", w.Code, etag)
+			}
+
+			r = newUserRequest(http.MethodPatch, "/api/videos/"+video.ID.String(), `{"title": "Fish"}`, userID, "")
+			r.SetPathValue("videoID", video.ID.String())
+			r.Header.Set("Content-Type", "application/merge-patch+json")
+			if ifMatch := tt.ifMatch(etag); ifMatch != "" {
+				r.Header.Set("If-Match", ifMatch)
+			}
+			w = httptest.NewRecorder()
+			cfg.handlerVideoMetaUpdate(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("PATCH status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if w.Code == http.StatusOK && w.Header().Get("ETag") == etag {
+				t.Errorf("ETag %s didn't change after the update", etag)
+			}
+		})
+	}
+}
+
+func TestVideoMetaDelete(t *testing.T) {
+	cfg := newTestConfig(t)
+	ownerID := createTestUser(t, cfg, "boots@example.com", "password")
+	otherID := createTestUser(t, cfg, "fish@example.com", "password")
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: ownerID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		videoID  uuid.UUID
+		userID   uuid.UUID
+		wantCode int
+	}{
+		{name: "missing video", videoID: uuid.New(), userID: ownerID, wantCode: http.StatusNotFound},
+		{name: "someone else's video", videoID: video.ID, userID: otherID, wantCode: http.StatusForbidden},
+		{name: "owner", videoID: video.ID, userID: ownerID, wantCode: http.StatusNoContent},
+		{name: "already in the trash", videoID: video.ID, userID: ownerID, wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := newUserRequest(http.MethodDelete, "/api/videos/"+tt.videoID.String(), "", tt.userID, "")
+		r.SetPathValue("videoID", tt.videoID.String())
+		w := httptest.NewRecorder()
+		cfg.handlerVideoMetaDelete(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+	}
+}
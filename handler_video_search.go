@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func (cfg *apiConfig) handlerVideosSearch(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Results []database.VideoSearchResult `json:"results"`
+	}
+
+	p, _ := requestPrincipal(r)
+
+	query := r.URL.Query()
+	params := database.SearchVideosParams{
+		UserID: p.UserID,
+		Query:  query.Get("q"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		params.Limit, err = strconv.Atoi(limit)
+		if err != nil || params.Limit < 1 || params.Limit > database.MaxSearchLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", database.MaxSearchLimit), err)
+			return
+		}
+	}
+
+	results, err := cfg.db.SearchVideos(params)
+	if errors.Is(err, database.ErrEmptySearchQuery) {
+		respondWithError(w, http.StatusBadRequest, "Search query q is required", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search videos", err)
+		return
+	}
+
+	for i := range results {
+		results[i].Video, err = cfg.dbVideoToSignedVideo(results[i].Video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Results: results,
+	})
+}
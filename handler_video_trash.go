@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideosTrash(w http.ResponseWriter, r *http.Request) {
+	p, _ := requestPrincipal(r)
+
+	cfg.listVideos(w, r, database.GetVideosParams{
+		UserID:  p.UserID,
+		Deleted: true,
+	})
+}
+
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	p, _ := requestPrincipal(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if !authorizeOwner(w, p, video.UserID) {
+		return
+	}
+	if video.DeletedAt == nil {
+		respondWithError(w, http.StatusConflict, "Video is not in the trash", nil)
+		return
+	}
+
+	err = cfg.db.RestoreVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+
+	cfg.respondWithVideo(w, http.StatusOK, video)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// uploadedImage is a JPEG or PNG read from a form, named after its content
+// like every asset.
+type uploadedImage struct {
+	data      []byte
+	mediaType string
+	key       string
+	checksum  string
+}
+
+// readImage reads the image in the multipart form field, which may be at
+// most maxSize bytes, and checks it against digest if the client sent one.
+// It responds with an error and returns false if the image can't be used.
+func readImage(w http.ResponseWriter, r *http.Request, field string, maxSize int64, digest *uploadDigest) (uploadedImage, bool) {
+	const maxMemory = 10 << 20
+	r.ParseMultipartForm(maxMemory)
+
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return uploadedImage{}, false
+	}
+	defer file.Close()
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could't parse mediatype", nil)
+		return uploadedImage{}, false
+	}
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		respondWithError(w, http.StatusBadRequest, "Invalid file format for "+field, nil)
+		return uploadedImage{}, false
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error reading file", err)
+		return uploadedImage{}, false
+	}
+	if int64(len(data)) > maxSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Image can't be larger than %d MB", maxSize>>20), nil)
+		return uploadedImage{}, false
+	}
+	if digest != nil {
+		digest.Write(data)
+		if err := digest.Verify(); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Image doesn't match the digest sent", err)
+			return uploadedImage{}, false
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	return uploadedImage{
+		data:      data,
+		mediaType: mediaType,
+		key:       getAssetPath(sum[:], mediaType),
+		checksum:  hex.EncodeToString(sum[:]),
+	}, true
+}
+
+// stageImage records a pending upload of image for the video or user in
+// params and writes it to the assets directory, unless it's already
+// stored. The upload then has to be committed, or aborted if that fails.
+func (cfg *apiConfig) stageImage(params database.CreateUploadParams, image uploadedImage) (database.Upload, error) {
+	params.Kind = database.UploadKindThumbnail
+	params.Key = image.key
+	upload, needsWrite, err := cfg.stageUpload(params)
+	if err != nil {
+		return database.Upload{}, fmt.Errorf("couldn't record upload: %w", err)
+	}
+	if !needsWrite {
+		return upload, nil
+	}
+
+	err = os.WriteFile(cfg.getAssetDiskPath(image.key), image.data, 0644)
+	if err != nil {
+		cfg.abortUpload(upload)
+		return database.Upload{}, fmt.Errorf("couldn't save file: %w", err)
+	}
+	_, err = cfg.db.CreateAsset(database.CreateAssetParams{
+		Kind:      database.UploadKindThumbnail,
+		Key:       image.key,
+		SHA256:    image.checksum,
+		Size:      int64(len(image.data)),
+		MediaType: image.mediaType,
+	})
+	if err != nil {
+		cfg.abortUpload(upload)
+		return database.Upload{}, fmt.Errorf("couldn't record asset: %w", err)
+	}
+	return upload, nil
+}
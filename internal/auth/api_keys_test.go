@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMakeAPIKey(t *testing.T) {
+	key, err := MakeAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) != len(apiKeyPrefix)+64 {
+		t.Errorf("key %q isn't %s followed by 64 hex digits", key, apiKeyPrefix)
+	}
+	if prefix := APIKeyDisplayPrefix(key); prefix != key[:len(apiKeyPrefix)+8] {
+		t.Errorf("display prefix = %q", prefix)
+	}
+
+	headers := http.Header{"Authorization": {"ApiKey " + key}}
+	if got, err := GetAPIKey(headers); err != nil || got != key {
+		t.Errorf("GetAPIKey() = %q, %v", got, err)
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -38,50 +39,78 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 	return match, nil
 }
 
+// accessClaims are the claims in an access token. The sid claim names the
+// session the token was issued for.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid,omitempty"`
+}
+
+// AccessToken is what a validated access token says about its bearer.
+type AccessToken struct {
+	UserID    uuid.UUID
+	SessionID string
+}
+
 func MakeJWT(
 	userID uuid.UUID,
-	tokenSecret string,
+	sessionID string,
+	keys *KeySet,
 	expiresIn time.Duration,
 ) (string, error) {
-	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+	return keys.sign(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		SessionID: sessionID,
 	})
-	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+func ValidateJWT(tokenString string, keys *KeySet) (uuid.UUID, error) {
+	token, err := ParseAccessToken(tokenString, keys)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return token.UserID, nil
+}
+
+// ParseAccessToken validates an access token and returns its user and
+// session.
+func ParseAccessToken(tokenString string, keys *KeySet) (AccessToken, error) {
+	claimsStruct := accessClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		keys.keyfunc,
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, err
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, err
 	}
 	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+		return AccessToken{}, errors.New("invalid issuer")
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return AccessToken{}, fmt.Errorf("invalid user ID: %w", err)
 	}
-	return id, nil
+	return AccessToken{
+		UserID:    id,
+		SessionID: claimsStruct.SessionID,
+	}, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -106,6 +135,42 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// apiKeyPrefix marks tubely API keys so they're easy to spot, for example
+// by secret scanners.
+const apiKeyPrefix = "tubely_"
+
+// MakeAPIKey returns a new random API key.
+func MakeAPIKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(key), nil
+}
+
+// HashAPIKey hashes an API key for storage. API keys are random, so unlike
+// passwords they don't need a slow hash.
+func HashAPIKey(key string) string {
+	return HashToken(key)
+}
+
+// HashToken hashes a random token, such as one sent by email, for storage.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyDisplayPrefix returns the start of an API key, which is enough for
+// users to recognize it without revealing it.
+func APIKeyDisplayPrefix(key string) string {
+	const length = len(apiKeyPrefix) + 8
+	if len(key) < length {
+		return key
+	}
+	return key[:length]
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,355 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestCheckPasswordHash(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "correct password", password: "correct horse", hash: hash, want: true},
+		{name: "wrong password", password: "battery staple", hash: hash},
+		{name: "empty password", password: "", hash: hash},
+		{name: "invalid hash", password: "correct horse", hash: "not-a-hash", wantErr: true},
+		{name: "no password set", password: "", hash: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := CheckPasswordHash(tt.password, tt.hash)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error = %v", err, tt.wantErr)
+			}
+			if match != tt.want {
+				t.Errorf("match = %v, want %v", match, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAccessToken(t *testing.T) {
+	userID := uuid.New()
+	dir := t.TempDir()
+	writeKey(t, dir, "ed", newEd25519Key(t))
+	writeKey(t, dir, "rsa", newRSAKey(t))
+	rsaOnly := t.TempDir()
+	writeKey(t, rsaOnly, "rsa", newRSAKey(t))
+
+	hmacKeys := NewHMACKeySet("secret")
+	edKeys := loadTestKeySet(t, dir, "ed", "secret")
+	rsaKeys := loadTestKeySet(t, dir, "rsa", "")
+	otherRSAKeys := loadTestKeySet(t, rsaOnly, "", "")
+
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		keys    *KeySet
+		wantErr string
+	}{
+		{
+			name:  "HMAC",
+			token: func(t *testing.T) string { return makeTestJWT(t, userID, hmacKeys, time.Hour) },
+			keys:  hmacKeys,
+		},
+		{
+			name:  "Ed25519",
+			token: func(t *testing.T) string { return makeTestJWT(t, userID, edKeys, time.Hour) },
+			keys:  edKeys,
+		},
+		{
+			name:  "RSA",
+			token: func(t *testing.T) string { return makeTestJWT(t, userID, rsaKeys, time.Hour) },
+			keys:  edKeys,
+		},
+		{
+			name:  "HMAC token after switching to keys",
+			token: func(t *testing.T) string { return makeTestJWT(t, userID, hmacKeys, time.Hour) },
+			keys:  edKeys,
+		},
+		{
+			name:    "HMAC token without a secret",
+			token:   func(t *testing.T) string { return makeTestJWT(t, userID, hmacKeys, time.Hour) },
+			keys:    rsaKeys,
+			wantErr: "no key ID",
+		},
+		{
+			name:    "wrong secret",
+			token:   func(t *testing.T) string { return makeTestJWT(t, userID, NewHMACKeySet("other"), time.Hour) },
+			keys:    hmacKeys,
+			wantErr: "signature is invalid",
+		},
+		{
+			name:    "same key ID, different key",
+			token:   func(t *testing.T) string { return makeTestJWT(t, userID, otherRSAKeys, time.Hour) },
+			keys:    rsaKeys,
+			wantErr: "verification error",
+		},
+		{
+			name:    "expired",
+			token:   func(t *testing.T) string { return makeTestJWT(t, userID, hmacKeys, -time.Minute) },
+			keys:    hmacKeys,
+			wantErr: "expired",
+		},
+		{
+			name: "unknown key ID",
+			token: func(t *testing.T) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, accessJWTClaims(userID))
+				token.Header["kid"] = "missing"
+				return signTestJWT(t, token, newEd25519Key(t))
+			},
+			keys:    edKeys,
+			wantErr: "unknown key ID",
+		},
+		{
+			name: "HMAC signed with a public key",
+			token: func(t *testing.T) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessJWTClaims(userID))
+				token.Header["kid"] = "ed"
+				return signTestJWT(t, token, []byte(edKeys.keys["ed"].public.(ed25519.PublicKey)))
+			},
+			keys:    edKeys,
+			wantErr: "unexpected signing method",
+		},
+		{
+			name: "unsigned",
+			token: func(t *testing.T) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, accessJWTClaims(userID))
+				return signTestJWT(t, token, jwt.UnsafeAllowNoneSignatureType)
+			},
+			keys:    hmacKeys,
+			wantErr: "unexpected signing method",
+		},
+		{
+			name: "another issuer",
+			token: func(t *testing.T) string {
+				claims := accessJWTClaims(userID)
+				claims.Issuer = "someone-else"
+				s, err := hmacKeys.sign(claims)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			},
+			keys:    hmacKeys,
+			wantErr: "invalid issuer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAccessToken(tt.token(t), tt.keys)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.UserID != userID || got.SessionID != "session" {
+				t.Errorf("token = %+v, want user %s in session %q", got, userID, "session")
+			}
+		})
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      map[string]any
+		signingID string
+		wantKID   string
+		wantErr   string
+	}{
+		{
+			name:    "signs with the last private key",
+			keys:    map[string]any{"2024": newEd25519Key(t), "2025": newEd25519Key(t)},
+			wantKID: "2025",
+		},
+		{
+			name:      "chosen signing key",
+			keys:      map[string]any{"2024": newEd25519Key(t), "2025": newEd25519Key(t)},
+			signingID: "2024",
+			wantKID:   "2024",
+		},
+		{
+			name:      "missing signing key",
+			keys:      map[string]any{"2024": newEd25519Key(t)},
+			signingID: "2025",
+			wantErr:   "not found",
+		},
+		{
+			name:      "public key can't sign",
+			keys:      map[string]any{"old": newEd25519Key(t).Public(), "new": newEd25519Key(t)},
+			signingID: "old",
+			wantErr:   "no private key",
+		},
+		{
+			name:    "no keys",
+			keys:    map[string]any{},
+			wantErr: "no private key",
+		},
+		{
+			name:    "small RSA key",
+			keys:    map[string]any{"small": mustRSAKey(t, 1024)},
+			wantErr: "at least 2048 bits",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for id, k := range tt.keys {
+				writeKey(t, dir, id, k)
+			}
+			ks, err := LoadKeySet(dir, tt.signingID, "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ks.signing.id != tt.wantKID {
+				t.Errorf("signing with %q, want %q", ks.signing.id, tt.wantKID)
+			}
+			if len(ks.JWKS().Keys) != len(tt.keys) {
+				t.Errorf("JWKS has %d keys, want %d", len(ks.JWKS().Keys), len(tt.keys))
+			}
+		})
+	}
+}
+
+func TestGetBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{name: "bearer token", header: "Bearer abc123", want: "abc123"},
+		{name: "no header", header: "", wantErr: true},
+		{name: "no token", header: "Bearer", wantErr: true},
+		{name: "API key", header: "ApiKey tubely_abc", wantErr: true},
+		{name: "lowercase scheme", header: "bearer abc123", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.header != "" {
+				headers.Set("Authorization", tt.header)
+			}
+			got, err := GetBearerToken(headers)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("GetBearerToken() = %q, %v, want %q, error = %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func accessJWTClaims(userID uuid.UUID) accessClaims {
+	return accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			Subject:   userID.String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		SessionID: "session",
+	}
+}
+
+func makeTestJWT(t *testing.T, userID uuid.UUID, keys *KeySet, expiresIn time.Duration) string {
+	t.Helper()
+	s, err := MakeJWT(userID, "session", keys, expiresIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func signTestJWT(t *testing.T, token *jwt.Token, key any) string {
+	t.Helper()
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func loadTestKeySet(t *testing.T, dir, signingKeyID, hmacSecret string) *KeySet {
+	t.Helper()
+	ks, err := LoadKeySet(dir, signingKeyID, hmacSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	return mustRSAKey(t, 2048)
+}
+
+func mustRSAKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// writeKey writes a private key as PKCS#8 or a public key as PKIX to
+// <id>.pem in dir.
+func writeKey(t *testing.T, dir, id string, k any) {
+	t.Helper()
+	var block *pem.Block
+	switch k := k.(type) {
+	case ed25519.PrivateKey, *rsa.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	}
+	if err := os.WriteFile(filepath.Join(dir, id+".pem"), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
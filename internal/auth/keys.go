@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// key is a key tokens can be verified with, and signed with if private is
+// set.
+type key struct {
+	id      string
+	method  jwt.SigningMethod
+	public  any
+	private any
+}
+
+// KeySet holds the key new access tokens are signed with and every key
+// tokens are still accepted from. Tokens carry the ID of the key that
+// signed them in their kid header.
+type KeySet struct {
+	signing *key
+	keys    map[string]*key
+	// hmacSecret verifies tokens without a kid, which were signed with the
+	// shared secret before asymmetric keys were configured.
+	hmacSecret []byte
+}
+
+// NewHMACKeySet signs and verifies tokens with a shared HS256 secret.
+func NewHMACKeySet(secret string) *KeySet {
+	return &KeySet{hmacSecret: []byte(secret)}
+}
+
+// LoadKeySet loads every <kid>.pem file in dir. Files holding a private
+// key (RSA or Ed25519, PKCS#1 or PKCS#8) can sign, files holding only a
+// public key can verify. Tokens are signed with signingKeyID, or with the
+// private key whose ID sorts last if it's empty. If hmacSecret isn't
+// empty, tokens signed with it before the switch to asymmetric keys are
+// still accepted.
+func LoadKeySet(dir, signingKeyID, hmacSecret string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ks := &KeySet{
+		keys:       map[string]*key{},
+		hmacSecret: []byte(hmacSecret),
+	}
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		k, err := loadKey(id, path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load key %s: %w", path, err)
+		}
+		ks.keys[id] = k
+		if k.private != nil && signingKeyID == "" {
+			ks.signing = k
+		}
+	}
+
+	if signingKeyID != "" {
+		ks.signing = ks.keys[signingKeyID]
+		if ks.signing == nil {
+			return nil, fmt.Errorf("signing key %q not found in %s", signingKeyID, dir)
+		}
+	}
+	if ks.signing == nil || ks.signing.private == nil {
+		return nil, fmt.Errorf("no private key to sign with in %s", dir)
+	}
+	return ks, nil
+}
+
+func loadKey(id, path string) (*key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &key{id: id}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		k.private = signer
+		parsed = signer.Public()
+	}
+	switch public := parsed.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.method = jwt.SigningMethodRS256
+		k.public = public
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+		k.public = public
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	return k, nil
+}
+
+// sign signs claims with the signing key.
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	if ks.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.hmacSecret)
+	}
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	token.Header["kid"] = ks.signing.id
+	return token.SignedString(ks.signing.private)
+}
+
+// keyfunc finds the key a token was signed with. The algorithm must match
+// the key's, so a public key can never be used as an HMAC secret.
+func (ks *KeySet) keyfunc(token *jwt.Token) (any, error) {
+	id, hasID := token.Header["kid"].(string)
+	if !hasID {
+		if len(ks.hmacSecret) == 0 {
+			return nil, errors.New("token has no key ID")
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return ks.hmacSecret, nil
+	}
+
+	k := ks.keys[id]
+	if k == nil {
+		return nil, fmt.Errorf("unknown key ID %q", id)
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), id)
+	}
+	return k.public, nil
+}
+
+// JSONWebKey is a public key in JWK format (RFC 7517).
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns the public keys tokens are verified with, so that other
+// services can verify them without sharing a secret.
+func (ks *KeySet) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		k := ks.keys[id]
+		jwk := JSONWebKey{
+			KeyID:     k.id,
+			Use:       "sig",
+			Algorithm: k.method.Alg(),
+		}
+		switch public := k.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key from RFC 6238's test vectors,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// rfc6238Vectors are the SHA-1 test vectors from RFC 6238 appendix B. The
+// RFC lists 8-digit codes; 6-digit codes are their last six digits.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestValidateTOTPVectors(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		now := time.Unix(tt.unix, 0)
+		step, ok := ValidateTOTP(rfc6238Secret, tt.code, now)
+		if !ok {
+			t.Errorf("ValidateTOTP(%q) at %d failed", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / totpPeriod; step != want {
+			t.Errorf("ValidateTOTP(%q) at %d = step %d, want %d", tt.code, tt.unix, step, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	const unix = 1111111111
+	step := int64(unix / totpPeriod)
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		at       int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", secret: rfc6238Secret, code: "050471", at: unix, wantStep: step, wantOK: true},
+		{name: "one step late", secret: rfc6238Secret, code: "050471", at: unix + totpPeriod, wantStep: step, wantOK: true},
+		{name: "one step early", secret: rfc6238Secret, code: "050471", at: unix - totpPeriod, wantStep: step, wantOK: true},
+		{name: "two steps late", secret: rfc6238Secret, code: "050471", at: unix + 2*totpPeriod},
+		{name: "spaces", secret: rfc6238Secret, code: "050 471", at: unix, wantStep: step, wantOK: true},
+		{name: "lowercase secret", secret: strings.ToLower(rfc6238Secret), code: "050471", at: unix, wantStep: step, wantOK: true},
+		{name: "wrong code", secret: rfc6238Secret, code: "050472", at: unix},
+		{name: "eight digits", secret: rfc6238Secret, code: "14050471", at: unix},
+		{name: "empty", secret: rfc6238Secret, code: "", at: unix},
+		{name: "invalid secret", secret: "not base32!", code: "050471", at: unix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := ValidateTOTP(tt.secret, tt.code, time.Unix(tt.at, 0))
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("ValidateTOTP() = %d, %v, want %d, %v", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q isn't base32: %v", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("secret is %d bytes, want 20", len(key))
+	}
+
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	if _, ok := ValidateTOTP(secret, code, time.Now()); !ok {
+		t.Errorf("code %s for a new secret didn't validate", code)
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	u, err := url.Parse(TOTPProvisioningURI(rfc6238Secret, "Tubely", "boots@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Tubely:boots@example.com" {
+		t.Errorf("URI = %s, want otpauth://totp/Tubely:boots@example.com", u)
+	}
+	want := map[string]string{
+		"secret":    rfc6238Secret,
+		"issuer":    "Tubely",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestMakeRecoveryCodes(t *testing.T) {
+	codes, err := MakeRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("got %d codes, want 10", len(codes))
+	}
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q isn't formatted like abcde-fghij", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := HashRecoveryCode("abcde-fghij")
+	tests := []struct {
+		code string
+		same bool
+	}{
+		{"abcde-fghij", true},
+		{"ABCDE-FGHIJ", true},
+		{"abcdefghij", true},
+		{" abcde fghij ", true},
+		{"abcde-fghik", false},
+		{"abcde", false},
+	}
+	for _, tt := range tests {
+		if got := HashRecoveryCode(tt.code) == want; got != tt.same {
+			t.Errorf("HashRecoveryCode(%q) matches = %v, want %v", tt.code, got, tt.same)
+		}
+	}
+}
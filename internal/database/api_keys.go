@@ -0,0 +1,177 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKeyScope limits what an API key can do.
+type APIKeyScope string
+
+const (
+	APIKeyScopeRead   APIKeyScope = "read"
+	APIKeyScopeUpload APIKeyScope = "upload"
+	APIKeyScopeDelete APIKeyScope = "delete"
+)
+
+func (s APIKeyScope) Valid() bool {
+	switch s {
+	case APIKeyScopeRead, APIKeyScopeUpload, APIKeyScopeDelete:
+		return true
+	}
+	return false
+}
+
+// APIKey is a key for programmatic access. Only a hash of the key is
+// stored; Prefix is kept so users can tell their keys apart.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"-"`
+	CreateAPIKeyParams
+}
+
+type CreateAPIKeyParams struct {
+	UserID uuid.UUID     `json:"user_id"`
+	Name   string        `json:"name"`
+	Prefix string        `json:"prefix"`
+	Hash   string        `json:"-"`
+	Scopes []APIKeyScope `json:"scopes"`
+}
+
+// HasScope reports whether the key was granted scope.
+func (k APIKey) HasScope(scope APIKeyScope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+const apiKeyColumns = `id, created_at, last_used_at, revoked_at, user_id, name, prefix, key_hash, scopes`
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	err := row.Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		&scopes,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = []APIKeyScope{}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope != "" {
+			key.Scopes = append(key.Scopes, APIKeyScope(scope))
+		}
+	}
+	return key, nil
+}
+
+func (c Client) CreateAPIKey(params CreateAPIKeyParams) (APIKey, error) {
+	id := uuid.New()
+	scopes := make([]string, len(params.Scopes))
+	for i, scope := range params.Scopes {
+		scopes[i] = string(scope)
+	}
+
+	query := `
+	INSERT INTO api_keys (
+		id,
+		created_at,
+		user_id,
+		name,
+		prefix,
+		key_hash,
+		scopes
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.UserID, params.Name, params.Prefix, params.Hash, strings.Join(scopes, ","))
+	if err != nil {
+		return APIKey{}, err
+	}
+	return c.GetAPIKey(id)
+}
+
+// GetAPIKey returns a key, revoked or not.
+func (c Client) GetAPIKey(id uuid.UUID) (APIKey, error) {
+	key, err := scanAPIKey(c.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, nil
+	}
+	return key, err
+}
+
+// GetAPIKeyByHash returns the unrevoked key with the given hash.
+func (c Client) GetAPIKeyByHash(hash string) (APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`
+	key, err := scanAPIKey(c.db.QueryRow(query, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, nil
+	}
+	return key, err
+}
+
+// GetAPIKeys returns a user's unrevoked keys, newest first.
+func (c Client) GetAPIKeys(userID uuid.UUID) ([]APIKey, error) {
+	query := `
+	SELECT ` + apiKeyColumns + `
+	FROM api_keys
+	WHERE user_id = ? AND revoked_at IS NULL
+	ORDER BY created_at DESC, id
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// apiKeyTouchInterval limits how often using a key writes its last-used
+// time.
+const apiKeyTouchInterval = time.Minute
+
+// TouchAPIKey records that a key was just used.
+func (c Client) TouchAPIKey(id uuid.UUID) error {
+	query := `
+	UPDATE api_keys
+	SET last_used_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)
+	`
+	_, err := c.db.Exec(query, id, time.Now().Add(-apiKeyTouchInterval).UTC().Format(sqliteTimestampFormat))
+	return err
+}
+
+func (c Client) RevokeAPIKey(id uuid.UUID) error {
+	query := `
+	UPDATE api_keys
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND revoked_at IS NULL
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
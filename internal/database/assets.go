@@ -0,0 +1,276 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Asset is a stored object keyed by the SHA-256 of its content. RefCount is
+// the number of committed uploads pointing at it; once it drops to zero the
+// object can be deleted.
+type Asset struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	RefCount  int       `json:"ref_count"`
+	CreateAssetParams
+}
+
+type CreateAssetParams struct {
+	Kind      UploadKind `json:"kind"`
+	Key       string     `json:"key"`
+	SHA256    string     `json:"sha256"`
+	Size      int64      `json:"size"`
+	MediaType string     `json:"media_type"`
+}
+
+const assetColumns = `
+		kind,
+		object_key,
+		created_at,
+		updated_at,
+		sha256,
+		size,
+		media_type,
+		ref_count`
+
+func scanAsset(row rowScanner) (Asset, error) {
+	var asset Asset
+	err := row.Scan(
+		&asset.Kind,
+		&asset.Key,
+		&asset.CreatedAt,
+		&asset.UpdatedAt,
+		&asset.SHA256,
+		&asset.Size,
+		&asset.MediaType,
+		&asset.RefCount,
+	)
+	return asset, err
+}
+
+// CreateAsset records an object that has been written to storage. Writing
+// the same content twice is a no-op.
+func (c Client) CreateAsset(params CreateAssetParams) (Asset, error) {
+	query := `
+	INSERT OR IGNORE INTO assets (
+		kind,
+		object_key,
+		created_at,
+		updated_at,
+		sha256,
+		size,
+		media_type,
+		ref_count
+	) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0)
+	`
+	_, err := c.db.Exec(query, params.Kind, params.Key, params.SHA256, params.Size, params.MediaType)
+	if err != nil {
+		return Asset{}, err
+	}
+	return c.GetAsset(params.Kind, params.Key)
+}
+
+func (c Client) GetAsset(kind UploadKind, key string) (Asset, error) {
+	return getAsset(c.db, kind, key)
+}
+
+func getAsset(db queryExecer, kind UploadKind, key string) (Asset, error) {
+	query := `
+	SELECT` + assetColumns + `
+	FROM assets
+	WHERE kind = ? AND object_key = ?
+	`
+	asset, err := scanAsset(db.QueryRow(query, kind, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Asset{}, nil
+		}
+		return Asset{}, err
+	}
+	return asset, nil
+}
+
+// GetAssetByKey looks an asset up by its key alone, for callers that only
+// know where an object is stored. Keys of different kinds don't overlap.
+func (c Client) GetAssetByKey(key string) (Asset, error) {
+	query := `
+	SELECT` + assetColumns + `
+	FROM assets
+	WHERE object_key = ?
+	ORDER BY kind
+	LIMIT 1
+	`
+	asset, err := scanAsset(c.db.QueryRow(query, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Asset{}, nil
+		}
+		return Asset{}, err
+	}
+	return asset, nil
+}
+
+// LiveObjects is everything that keeps stored objects from being garbage
+// collected.
+type LiveObjects struct {
+	Videos  []ObjectReference
+	Pending []Upload
+	// Avatars are the keys of thumbnail assets used as avatars.
+	Avatars []string
+}
+
+// GetLiveObjects reads the objects videos and avatars point at, and the
+// uploads pending since before pendingBefore, in one transaction. Read
+// separately, an upload that commits in between would be in neither list.
+func (c Client) GetLiveObjects(pendingBefore time.Time) (LiveObjects, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return LiveObjects{}, err
+	}
+	defer tx.Rollback()
+
+	var live LiveObjects
+	if live.Videos, err = getObjectReferences(tx); err != nil {
+		return LiveObjects{}, err
+	}
+	if live.Pending, err = getPendingUploads(tx, pendingBefore); err != nil {
+		return LiveObjects{}, err
+	}
+	if live.Avatars, err = getAvatarKeys(tx); err != nil {
+		return LiveObjects{}, err
+	}
+	return live, tx.Commit()
+}
+
+// IsAssetInUse reports whether an object is referenced by a committed upload
+// or still being written by a pending one other than exceptUploadID.
+func (c Client) IsAssetInUse(kind UploadKind, key string, exceptUploadID uuid.UUID) (bool, error) {
+	query := `
+	SELECT
+		EXISTS (
+			SELECT 1 FROM assets
+			WHERE kind = ? AND object_key = ? AND ref_count > 0
+		) OR EXISTS (
+			SELECT 1 FROM uploads
+			WHERE kind = ? AND object_key = ? AND status = ? AND id != ?
+		)
+	`
+	var inUse bool
+	err := c.db.QueryRow(query, kind, key, kind, key, UploadStatusPending, exceptUploadID).Scan(&inUse)
+	return inUse, err
+}
+
+// DeleteAsset removes the record of an object nothing references anymore.
+// It returns false if the asset gained a reference in the meantime, or if
+// an upload other than exceptUploadID is staging the same content, since
+// that upload may have just written the object again.
+func (c Client) DeleteAsset(kind UploadKind, key string, exceptUploadID uuid.UUID) (bool, error) {
+	query := `
+	DELETE FROM assets
+	WHERE kind = ? AND object_key = ? AND ref_count = 0
+	AND NOT EXISTS (
+		SELECT 1 FROM uploads
+		WHERE kind = ? AND object_key = ? AND status = ? AND id != ?
+	)
+	`
+	result, err := c.db.Exec(query, kind, key, kind, key, UploadStatusPending, exceptUploadID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// releaseUploads drops the references held by the given uploads and moves
+// them to status, so they are never released twice.
+func releaseUploads(tx *sql.Tx, where string, status UploadStatus, args ...any) error {
+	_, err := tx.Exec(`
+	UPDATE assets
+	SET ref_count = ref_count - 1, updated_at = CURRENT_TIMESTAMP
+	WHERE ref_count > 0 AND (kind, object_key) IN (
+		SELECT kind, object_key FROM uploads WHERE status = 'committed' AND `+where+`
+	)
+	`, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	UPDATE uploads
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE status = 'committed' AND `+where, append([]any{status}, args...)...)
+	return err
+}
+
+// ReleaseVideoAssets drops every reference a trashed video holds, deducts
+// them from the owner's usage and returns the assets linked to the video
+// that are no longer referenced by anything. The video must have been moved
+// to the trash before deletedBefore, or ErrVideoNotTrashed is returned. It
+// is safe to call again if deleting those assets fails part way.
+func (c Client) ReleaseVideoAssets(videoID uuid.UUID, deletedBefore time.Time) ([]Asset, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	userID, err := trashedVideoOwner(tx, videoID, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	err = ensureUsage(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	releasedBytes, err := committedBytes(tx, "u.video_id = ?", videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = releaseUploads(tx, "video_id = ?", UploadStatusReleased, videoID)
+	if err != nil {
+		return nil, err
+	}
+	err = addUsage(tx, userID, usageDelta{bytes: -releasedBytes})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return unreferencedAssets(c.db, "u.video_id = ?", videoID)
+}
+
+func unreferencedAssets(q querier, where string, args ...any) ([]Asset, error) {
+	query := `
+	SELECT DISTINCT
+		a.kind,
+		a.object_key,
+		a.created_at,
+		a.updated_at,
+		a.sha256,
+		a.size,
+		a.media_type,
+		a.ref_count
+	FROM assets a
+	JOIN uploads u ON u.kind = a.kind AND u.object_key = a.object_key
+	WHERE a.ref_count = 0 AND ` + where
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []Asset{}
+	for rows.Next() {
+		asset, err := scanAsset(rows)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
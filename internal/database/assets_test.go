@@ -0,0 +1,124 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDeleteAsset(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup stages and commits uploads of the asset, returning the
+		// upload that's deleting it.
+		setup func(t *testing.T, c Client, video Video) uuid.UUID
+		want  bool
+	}{
+		{
+			name:  "unreferenced",
+			setup: func(t *testing.T, c Client, video Video) uuid.UUID { return uuid.Nil },
+			want:  true,
+		},
+		{
+			name: "referenced",
+			setup: func(t *testing.T, c Client, video Video) uuid.UUID {
+				upload := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindThumbnail, Key: "a.png"})
+				commitTestUpload(t, c, upload, video)
+				return uuid.Nil
+			},
+		},
+		{
+			name: "only the failed upload's",
+			setup: func(t *testing.T, c Client, video Video) uuid.UUID {
+				return stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindThumbnail, Key: "a.png"}).ID
+			},
+			want: true,
+		},
+		{
+			name: "staged again by another upload",
+			setup: func(t *testing.T, c Client, video Video) uuid.UUID {
+				failed := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindThumbnail, Key: "a.png"})
+				stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindThumbnail, Key: "a.png"})
+				return failed.ID
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			userID := createTestUser(t, c, "boots@example.com")
+			video := createTestVideo(t, c, userID, "Boots", "")
+			createTestAsset(t, c, UploadKindThumbnail, "a.png", 10)
+			except := tt.setup(t, c, video)
+
+			deleted, err := c.DeleteAsset(UploadKindThumbnail, "a.png", except)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tt.want {
+				t.Errorf("deleted = %v, want %v", deleted, tt.want)
+			}
+			asset, err := c.GetAsset(UploadKindThumbnail, "a.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (asset.Key == "") != tt.want {
+				t.Errorf("asset record exists = %v after deleted = %v", asset.Key != "", deleted)
+			}
+		})
+	}
+}
+
+func TestReleaseVideoAssets(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	video := createTestVideo(t, c, userID, "Boots", "")
+	other := createTestVideo(t, c, userID, "Other", "")
+	createTestAsset(t, c, UploadKindVideo, "a.mp4", 100)
+	createTestAsset(t, c, UploadKindThumbnail, "shared.png", 10)
+
+	upload := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindVideo, Key: "a.mp4"})
+	video, _ = commitTestUpload(t, c, upload, video)
+	for _, v := range []Video{video, other} {
+		upload := stageTestUpload(t, c, CreateUploadParams{VideoID: v.ID, Kind: UploadKindThumbnail, Key: "shared.png"})
+		commitTestUpload(t, c, upload, v)
+	}
+	checkUsage(t, c, userID, Usage{BytesStored: 120, VideoCount: 2, MonthlyUploadBytes: 120})
+
+	cutoff := time.Now().Add(time.Second)
+	if _, err := c.ReleaseVideoAssets(video.ID, cutoff); !errors.Is(err, ErrVideoNotTrashed) {
+		t.Fatalf("releasing a live video: error = %v, want ErrVideoNotTrashed", err)
+	}
+	if err := c.TrashVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReleaseVideoAssets(video.ID, time.Now().Add(-time.Hour)); !errors.Is(err, ErrVideoNotTrashed) {
+		t.Fatalf("releasing a video trashed after the cutoff: error = %v, want ErrVideoNotTrashed", err)
+	}
+
+	released, err := c.ReleaseVideoAssets(video.ID, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(assetKeys(released), []string{"a.mp4"}) {
+		t.Errorf("released %v, want [a.mp4]", assetKeys(released))
+	}
+	checkRefCount(t, c, UploadKindVideo, "a.mp4", 0)
+	checkRefCount(t, c, UploadKindThumbnail, "shared.png", 1)
+	checkUploadStatus(t, c, upload.ID, UploadStatusReleased)
+	checkUsage(t, c, userID, Usage{BytesStored: 10, VideoCount: 2, MonthlyUploadBytes: 120})
+
+	// Releasing again, as a retried purge would, changes nothing.
+	released, err = c.ReleaseVideoAssets(video.ID, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(assetKeys(released), []string{"a.mp4"}) {
+		t.Errorf("second release returned %v, want [a.mp4]", assetKeys(released))
+	}
+	checkRefCount(t, c, UploadKindThumbnail, "shared.png", 1)
+	checkUsage(t, c, userID, Usage{BytesStored: 10, VideoCount: 2, MonthlyUploadBytes: 120})
+}
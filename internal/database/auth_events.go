@@ -0,0 +1,159 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuthEventType is something that happened to an account's credentials or
+// sessions, or an admin action on the account.
+type AuthEventType string
+
+const (
+	AuthEventLogin          AuthEventType = "login"
+	AuthEventLoginFailed    AuthEventType = "login_failed"
+	AuthEventRefresh        AuthEventType = "refresh"
+	AuthEventRefreshReused  AuthEventType = "refresh_reused"
+	AuthEventRevoke         AuthEventType = "revoke"
+	AuthEventPasswordChange AuthEventType = "password_change"
+	AuthEventEmailChange    AuthEventType = "email_change"
+	AuthEventMFAEnabled     AuthEventType = "mfa_enabled"
+	AuthEventMFADisabled    AuthEventType = "mfa_disabled"
+	AuthEventLocked         AuthEventType = "locked"
+	AuthEventUnlocked       AuthEventType = "unlocked"
+	AuthEventDisabled       AuthEventType = "disabled"
+	AuthEventEnabled        AuthEventType = "enabled"
+	AuthEventRoleChanged    AuthEventType = "role_changed"
+	// Admins moving or taking down a user's videos is recorded against
+	// the owners, with the video's ID as the detail.
+	AuthEventVideoTransferred AuthEventType = "video_transferred"
+	AuthEventVideoTakenDown   AuthEventType = "video_taken_down"
+	// AuthEventDeletionRequested is deleted along with the rest of the
+	// user's events once their account is.
+	AuthEventDeletionRequested AuthEventType = "deletion_requested"
+)
+
+const (
+	DefaultAuthEventPageLimit = 50
+	MaxAuthEventPageLimit     = 100
+)
+
+// AuthEvent is an entry in the audit log. UserID is nil for failed logins
+// with an email address no account has.
+type AuthEvent struct {
+	ID        int64         `json:"id"`
+	CreatedAt time.Time     `json:"created_at"`
+	UserID    *uuid.UUID    `json:"user_id"`
+	Type      AuthEventType `json:"type"`
+	Detail    string        `json:"detail"`
+	UserAgent string        `json:"user_agent"`
+	IP        string        `json:"ip"`
+}
+
+type CreateAuthEventParams struct {
+	Type AuthEventType
+	// Detail qualifies the type, such as how a user logged in or why a
+	// login failed.
+	Detail string
+	SessionClient
+}
+
+const authEventColumns = `id, created_at, user_id, type, detail, ip, user_agent`
+
+func scanAuthEvent(row rowScanner) (AuthEvent, error) {
+	var event AuthEvent
+	err := row.Scan(
+		&event.ID,
+		&event.CreatedAt,
+		&event.UserID,
+		&event.Type,
+		&event.Detail,
+		&event.IP,
+		&event.UserAgent,
+	)
+	return event, err
+}
+
+func (c Client) CreateAuthEvent(userID *uuid.UUID, params CreateAuthEventParams) error {
+	query := `
+		INSERT INTO auth_events (created_at, user_id, type, detail, ip, user_agent)
+		VALUES (CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, userID, params.Type, params.Detail, params.IP, params.userAgent())
+	return err
+}
+
+type GetAuthEventsParams struct {
+	// UserID limits the listing to one user's events. Leave it nil to
+	// list everyone's.
+	UserID *uuid.UUID
+	Limit  int
+	Cursor string
+}
+
+type AuthEventPage struct {
+	Events     []AuthEvent `json:"events"`
+	NextCursor *string     `json:"next_cursor"`
+}
+
+// GetAuthEvents returns one page of events, newest first. The cursor is the
+// ID of the last event returned.
+func (c Client) GetAuthEvents(params GetAuthEventsParams) (AuthEventPage, error) {
+	if params.Limit <= 0 {
+		params.Limit = DefaultAuthEventPageLimit
+	}
+	if params.Limit > MaxAuthEventPageLimit {
+		params.Limit = MaxAuthEventPageLimit
+	}
+
+	query := `
+	SELECT ` + authEventColumns + `
+	FROM auth_events
+	WHERE 1 = 1
+	`
+	args := []any{}
+	if params.UserID != nil {
+		query += "AND user_id = ?\n"
+		args = append(args, *params.UserID)
+	}
+	if params.Cursor != "" {
+		before, err := strconv.ParseInt(params.Cursor, 10, 64)
+		if err != nil {
+			return AuthEventPage{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+		}
+		query += "AND id < ?\n"
+		args = append(args, before)
+	}
+	query += "ORDER BY id DESC\nLIMIT ?"
+	// Fetch one extra row to learn whether another page exists.
+	args = append(args, params.Limit+1)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return AuthEventPage{}, err
+	}
+	defer rows.Close()
+
+	events := []AuthEvent{}
+	for rows.Next() {
+		event, err := scanAuthEvent(rows)
+		if err != nil {
+			return AuthEventPage{}, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return AuthEventPage{}, err
+	}
+
+	page := AuthEventPage{Events: events}
+	if len(events) > params.Limit {
+		page.Events = events[:params.Limit]
+		next := strconv.FormatInt(page.Events[params.Limit-1].ID, 10)
+		page.NextCursor = &next
+	}
+	return page, nil
+}
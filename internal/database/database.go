@@ -2,21 +2,31 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Client struct {
 	db *sql.DB
+	// fts is false when the SQLite driver was built without FTS5, in
+	// which case search falls back to LIKE matching.
+	fts bool
 }
 
 func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+	// SQLite only enforces foreign keys when asked to, on each connection.
+	dsn := pathToDB + "?_foreign_keys=on"
+	if strings.Contains(pathToDB, "?") {
+		dsn = pathToDB + "&_foreign_keys=on"
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{db: db}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -39,6 +49,60 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	for _, column := range []string{"quota_bytes", "quota_videos", "quota_monthly_upload_bytes"} {
+		err = c.addColumnIfNotExists("users", column, "INTEGER")
+		if err != nil {
+			return err
+		}
+	}
+	err = c.addColumnIfNotExists("users", "role", "TEXT NOT NULL DEFAULT 'user'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "disabled_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "email_verified_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "totp_secret", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "totp_enabled_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "totp_last_step", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "failed_login_count", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "locked_until", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "deleted_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	for _, column := range []string{"display_name", "bio"} {
+		err = c.addColumnIfNotExists("users", column, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+	}
+	for _, column := range []string{"avatar_key", "avatar_url"} {
+		err = c.addColumnIfNotExists("users", column, "TEXT")
+		if err != nil {
+			return err
+		}
+	}
 	refreshTokenTable := `
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 		token TEXT PRIMARY KEY,
@@ -54,6 +118,158 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfNotExists("refresh_tokens", "family_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("refresh_tokens", "replaced_by", "TEXT")
+	if err != nil {
+		return err
+	}
+	// Tokens issued before rotation each start their own family.
+	_, err = c.db.Exec("UPDATE refresh_tokens SET family_id = token WHERE family_id IS NULL")
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id)")
+	if err != nil {
+		return err
+	}
+
+	sessionTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id, last_used_at);
+	`
+	_, err = c.db.Exec(sessionTable)
+	if err != nil {
+		return err
+	}
+
+	apiKeyTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id, created_at);
+	`
+	_, err = c.db.Exec(apiKeyTable)
+	if err != nil {
+		return err
+	}
+	userTokenTable := `
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		email TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_tokens_user ON user_tokens(user_id, purpose);
+	`
+	_, err = c.db.Exec(userTokenTable)
+	if err != nil {
+		return err
+	}
+	mfaTables := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		PRIMARY KEY(user_id, code_hash),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE TABLE IF NOT EXISTS mfa_challenges (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		used_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(mfaTables)
+	if err != nil {
+		return err
+	}
+	oidcTables := `
+	CREATE TABLE IF NOT EXISTS oidc_states (
+		state_hash TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(issuer, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities(user_id);
+	`
+	_, err = c.db.Exec(oidcTables)
+	if err != nil {
+		return err
+	}
+	authEventTable := `
+	CREATE TABLE IF NOT EXISTS auth_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT,
+		type TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_auth_events_user ON auth_events(user_id, id);
+	`
+	_, err = c.db.Exec(authEventTable)
+	if err != nil {
+		return err
+	}
+	// Refresh token families issued before sessions existed become
+	// sessions without client details.
+	_, err = c.db.Exec(`
+	INSERT OR IGNORE INTO sessions (id, user_id, created_at, last_used_at, expires_at, revoked_at)
+	SELECT
+		family_id,
+		user_id,
+		min(created_at),
+		max(updated_at),
+		strftime('%Y-%m-%d %H:%M:%S', max(expires_at)),
+		CASE WHEN count(revoked_at) = count(*) THEN max(revoked_at) END
+	FROM refresh_tokens
+	GROUP BY family_id
+	`)
+	if err != nil {
+		return err
+	}
 
 	videoTable := `
 	CREATE TABLE IF NOT EXISTS videos (
@@ -72,18 +288,232 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfNotExists("videos", "version", "INTEGER NOT NULL DEFAULT 1")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "duration", "REAL NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "deleted_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "visibility", "TEXT NOT NULL DEFAULT 'private'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "thumbnail_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "video_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	videoIndexes := `
+	CREATE INDEX IF NOT EXISTS idx_videos_user_created_at ON videos(user_id, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_user_updated_at ON videos(user_id, updated_at, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_user_title ON videos(user_id, title, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_user_duration ON videos(user_id, duration, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_visibility_created_at ON videos(visibility, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_visibility_updated_at ON videos(visibility, updated_at, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_visibility_title ON videos(visibility, title, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_visibility_duration ON videos(visibility, duration, id);
+	CREATE INDEX IF NOT EXISTS idx_videos_deleted_at ON videos(deleted_at) WHERE deleted_at IS NOT NULL;
+	`
+	_, err = c.db.Exec(videoIndexes)
+	if err != nil {
+		return err
+	}
+
+	// Without FTS5, search falls back to LIKE matching. FullTextSearch
+	// tells callers which one they got.
+	err = c.migrateSearchIndex()
+	if err != nil && !errors.Is(err, errNoFTS5) {
+		return err
+	}
+	c.fts = err == nil
+
+	_, err = c.db.Exec(`CREATE TABLE IF NOT EXISTS uploads (` + uploadTableColumns + `)`)
+	if err != nil {
+		return err
+	}
+	err = c.migrateAvatarUploads()
+	if err != nil {
+		return err
+	}
+	uploadIndexes := `
+	CREATE INDEX IF NOT EXISTS idx_uploads_status ON uploads(status, created_at);
+	CREATE INDEX IF NOT EXISTS idx_uploads_video ON uploads(video_id, kind);
+	CREATE INDEX IF NOT EXISTS idx_uploads_user ON uploads(user_id) WHERE user_id IS NOT NULL;
+	`
+	_, err = c.db.Exec(uploadIndexes)
+	if err != nil {
+		return err
+	}
+
+	assetTable := `
+	CREATE TABLE IF NOT EXISTS assets (
+		kind TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		media_type TEXT NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(kind, object_key)
+	);
+	CREATE INDEX IF NOT EXISTS idx_uploads_object ON uploads(kind, object_key);
+	`
+	_, err = c.db.Exec(assetTable)
+	if err != nil {
+		return err
+	}
+
+	usageTable := `
+	CREATE TABLE IF NOT EXISTS user_usage (
+		user_id TEXT PRIMARY KEY,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		bytes_stored INTEGER NOT NULL DEFAULT 0,
+		video_count INTEGER NOT NULL DEFAULT 0,
+		upload_month TEXT NOT NULL,
+		monthly_upload_bytes INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(usageTable)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// uploadTableColumns defines the uploads table. Uploads of a video's files
+// have a video_id, and uploads of avatars a user_id instead.
+const uploadTableColumns = `
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT,
+		user_id TEXT,
+		kind TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		status TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	`
+
+// migrateAvatarUploads copies an uploads table from before avatars were
+// uploaded into one where video_id may be null, since SQLite can't drop a
+// NOT NULL constraint in place.
+func (c *Client) migrateAvatarUploads() error {
+	var videoIDNotNull bool
+	err := c.db.QueryRow(`SELECT "notnull" FROM pragma_table_info('uploads') WHERE name = 'video_id'`).Scan(&videoIDNotNull)
+	if err != nil || !videoIDNotNull {
+		return err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	CREATE TABLE uploads_new (` + uploadTableColumns + `);
+	INSERT INTO uploads_new (id, created_at, updated_at, video_id, kind, object_key, status)
+	SELECT id, created_at, updated_at, video_id, kind, object_key, status FROM uploads;
+	DROP TABLE uploads;
+	ALTER TABLE uploads_new RENAME TO uploads;
+	`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumnIfNotExists lets autoMigrate extend tables that were created by
+// an older version of the schema, since CREATE TABLE IF NOT EXISTS leaves
+// them untouched.
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Reset deletes every row, children before the rows they refer to so
+// foreign keys aren't violated part way.
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+	if _, err := c.db.Exec("DELETE FROM sessions"); err != nil {
+		return fmt.Errorf("failed to reset table sessions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM api_keys"); err != nil {
+		return fmt.Errorf("failed to reset table api_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table user_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM recovery_codes"); err != nil {
+		return fmt.Errorf("failed to reset table recovery_codes: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM mfa_challenges"); err != nil {
+		return fmt.Errorf("failed to reset table mfa_challenges: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM auth_events"); err != nil {
+		return fmt.Errorf("failed to reset table auth_events: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM oidc_states"); err != nil {
+		return fmt.Errorf("failed to reset table oidc_states: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_identities"); err != nil {
+		return fmt.Errorf("failed to reset table user_identities: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_usage"); err != nil {
+		return fmt.Errorf("failed to reset table user_usage: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM uploads"); err != nil {
+		return fmt.Errorf("failed to reset table uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM assets"); err != nil {
+		return fmt.Errorf("failed to reset table assets: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
 	return nil
 }
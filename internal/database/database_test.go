@@ -0,0 +1,36 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+func createTestUser(t *testing.T, c Client, email string) uuid.UUID {
+	t.Helper()
+	user, err := c.CreateUser(CreateUserParams{Email: email, Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+func createTestVideo(t *testing.T, c Client, userID uuid.UUID, title, description string) Video {
+	t.Helper()
+	video, err := c.CreateVideo(CreateVideoParams{Title: title, Description: description, UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
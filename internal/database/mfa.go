@@ -0,0 +1,204 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TOTP is a user's authenticator secret. It is pending until EnabledAt is
+// set, which happens once the user confirms a code from it.
+type TOTP struct {
+	Secret    string
+	EnabledAt *time.Time
+}
+
+func (c Client) GetTOTP(userID uuid.UUID) (TOTP, error) {
+	var totp TOTP
+	var secret sql.NullString
+	err := c.db.QueryRow(`
+		SELECT totp_secret, totp_enabled_at
+		FROM users
+		WHERE id = ?
+	`, userID).Scan(&secret, &totp.EnabledAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, nil
+	}
+	if err != nil {
+		return TOTP{}, err
+	}
+	totp.Secret = secret.String
+	return totp, nil
+}
+
+// SetPendingTOTP replaces the secret a user is enrolling with. It does
+// nothing once TOTP is enabled.
+func (c Client) SetPendingTOTP(userID uuid.UUID, secret string) error {
+	_, err := c.db.Exec(`
+		UPDATE users
+		SET totp_secret = ?, totp_last_step = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND totp_enabled_at IS NULL
+	`, secret, userID)
+	return err
+}
+
+// EnableTOTP turns on a user's pending secret, recording step as the last
+// code used, and replaces their recovery codes.
+func (c Client) EnableTOTP(userID uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND totp_secret IS NOT NULL
+	`, step, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash, created_at)
+			VALUES (?, ?, CURRENT_TIMESTAMP)
+		`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP removes a user's secret and recovery codes, and any login
+// waiting on a code.
+func (c Client) DisableTOTP(userID uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM mfa_challenges WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code for step was used. It reports false if
+// a code for that step or a later one already was, so codes can't be
+// replayed.
+func (c Client) UseTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	result, err := c.db.Exec(`
+		UPDATE users
+		SET totp_last_step = ?
+		WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)
+	`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode marks a recovery code as used, reporting false if the
+// user has no unused code with that hash.
+func (c Client) UseRecoveryCode(userID uuid.UUID, hash string) (bool, error) {
+	result, err := c.db.Exec(`
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has.
+func (c Client) CountRecoveryCodes(userID uuid.UUID) (int, error) {
+	var count int
+	err := c.db.QueryRow(`
+		SELECT count(*)
+		FROM recovery_codes
+		WHERE user_id = ? AND used_at IS NULL
+	`, userID).Scan(&count)
+	return count, err
+}
+
+// MFAChallenge is a login that has passed the password check and is
+// waiting for a second factor.
+type MFAChallenge struct {
+	UserID    uuid.UUID
+	ExpiresAt time.Time
+	Attempts  int
+	UsedAt    *time.Time
+}
+
+func (c Client) CreateMFAChallenge(userID uuid.UUID, hash string, expiresAt time.Time) error {
+	_, err := c.db.Exec(`
+		INSERT INTO mfa_challenges (token_hash, user_id, created_at, expires_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`, hash, userID, expiresAt.UTC().Format(sqliteTimestampFormat))
+	return err
+}
+
+// GetMFAChallenge returns the challenge with the given hash, or a zero
+// MFAChallenge if there isn't one.
+func (c Client) GetMFAChallenge(hash string) (MFAChallenge, error) {
+	var challenge MFAChallenge
+	err := c.db.QueryRow(`
+		SELECT user_id, expires_at, attempts, used_at
+		FROM mfa_challenges
+		WHERE token_hash = ?
+	`, hash).Scan(&challenge.UserID, &challenge.ExpiresAt, &challenge.Attempts, &challenge.UsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return MFAChallenge{}, nil
+	}
+	return challenge, err
+}
+
+func (c Client) RecordMFAChallengeFailure(hash string) error {
+	_, err := c.db.Exec(`
+		UPDATE mfa_challenges
+		SET attempts = attempts + 1
+		WHERE token_hash = ?
+	`, hash)
+	return err
+}
+
+// CompleteMFAChallenge marks a challenge as used, reporting false if it
+// already was.
+func (c Client) CompleteMFAChallenge(hash string) (bool, error) {
+	result, err := c.db.Exec(`
+		UPDATE mfa_challenges
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND used_at IS NULL
+	`, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OIDCState is a single sign-on login waiting for the provider to send the
+// user back.
+type OIDCState struct {
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// CreateOIDCState saves a login under a hash of its state parameter,
+// clearing out logins that were never finished.
+func (c Client) CreateOIDCState(stateHash string, state OIDCState) error {
+	_, err := c.db.Exec(`DELETE FROM oidc_states WHERE expires_at < ?`, time.Now().UTC().Format(sqliteTimestampFormat))
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`
+		INSERT INTO oidc_states (state_hash, nonce, code_verifier, created_at, expires_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`, stateHash, state.Nonce, state.CodeVerifier, state.ExpiresAt.UTC().Format(sqliteTimestampFormat))
+	return err
+}
+
+// ConsumeOIDCState deletes and returns the login with the given state
+// hash, so it can only be finished once. It returns a zero OIDCState if
+// there isn't one.
+func (c Client) ConsumeOIDCState(stateHash string) (OIDCState, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return OIDCState{}, err
+	}
+	defer tx.Rollback()
+
+	var state OIDCState
+	err = tx.QueryRow(`
+		SELECT nonce, code_verifier, expires_at
+		FROM oidc_states
+		WHERE state_hash = ?
+	`, stateHash).Scan(&state.Nonce, &state.CodeVerifier, &state.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OIDCState{}, nil
+	}
+	if err != nil {
+		return OIDCState{}, err
+	}
+	_, err = tx.Exec(`DELETE FROM oidc_states WHERE state_hash = ?`, stateHash)
+	if err != nil {
+		return OIDCState{}, err
+	}
+	return state, tx.Commit()
+}
+
+// GetUserByIdentity returns the user linked to a provider's subject, or
+// nil if there isn't one.
+func (c Client) GetUserByIdentity(issuer, subject string) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?)
+	`
+	user, err := scanUser(c.db.QueryRow(query, issuer, subject))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func linkIdentity(db execer, userID uuid.UUID, issuer, subject string) error {
+	_, err := db.Exec(`
+		INSERT INTO user_identities (issuer, subject, user_id, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	`, issuer, subject, userID)
+	return err
+}
+
+// LinkIdentity links a provider's subject to an existing user, whose email
+// address the caller must have checked is verified by both the provider
+// and the user.
+func (c Client) LinkIdentity(userID uuid.UUID, issuer, subject string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = linkIdentity(tx, userID, issuer, subject)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateUserWithIdentity provisions a user who logged in with single
+// sign-on. They have no password, so they can only log in through the
+// provider unless they reset it.
+func (c Client) CreateUserWithIdentity(email, issuer, subject string) (*User, error) {
+	id := uuid.New()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO users
+		    (id, created_at, updated_at, email, password, email_verified_at)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, '', CURRENT_TIMESTAMP)
+	`, id.String(), email)
+	if err != nil {
+		return nil, err
+	}
+	err = linkIdentity(tx, id, issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return c.GetUser(id)
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// VideoSort is a column videos can be listed by. Each sort has a fixed
+// direction and is backed by indexes on (user_id, column, id) and
+// (visibility, column, id).
+type VideoSort string
+
+const (
+	VideoSortCreatedAt VideoSort = "created_at"
+	VideoSortUpdatedAt VideoSort = "updated_at"
+	VideoSortTitle     VideoSort = "title"
+	VideoSortDuration  VideoSort = "duration"
+)
+
+const (
+	DefaultVideoPageLimit = 50
+	MaxVideoPageLimit     = 100
+)
+
+func (s VideoSort) descending() bool {
+	return s != VideoSortTitle
+}
+
+func (s VideoSort) Valid() bool {
+	switch s {
+	case VideoSortCreatedAt, VideoSortUpdatedAt, VideoSortTitle, VideoSortDuration:
+		return true
+	}
+	return false
+}
+
+func (s VideoSort) value(video Video) any {
+	switch s {
+	case VideoSortUpdatedAt:
+		return video.UpdatedAt.UTC().Format(sqliteTimestampFormat)
+	case VideoSortTitle:
+		return video.Title
+	case VideoSortDuration:
+		return video.Duration
+	default:
+		return video.CreatedAt.UTC().Format(sqliteTimestampFormat)
+	}
+}
+
+// sqliteTimestampFormat matches what CURRENT_TIMESTAMP stores, so cursor
+// values compare correctly against the raw column.
+const sqliteTimestampFormat = "2006-01-02 15:04:05"
+
+// videoCursor is the position after the last video of a page. It is handed
+// to clients base64 encoded so they treat it as opaque.
+type videoCursor struct {
+	Sort  VideoSort `json:"s"`
+	Value any       `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+func encodeVideoCursor(sort VideoSort, video Video) (string, error) {
+	dat, err := json.Marshal(videoCursor{
+		Sort:  sort,
+		Value: sort.value(video),
+		ID:    video.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(dat), nil
+}
+
+func decodeVideoCursor(sort VideoSort, s string) (videoCursor, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return videoCursor{}, ErrInvalidCursor
+	}
+	var cursor videoCursor
+	if err := json.Unmarshal(dat, &cursor); err != nil {
+		return videoCursor{}, ErrInvalidCursor
+	}
+	if cursor.Sort != sort {
+		return videoCursor{}, fmt.Errorf("%w: cursor was issued for sort %q", ErrInvalidCursor, cursor.Sort)
+	}
+	_, isNumber := cursor.Value.(float64)
+	_, isString := cursor.Value.(string)
+	if (sort == VideoSortDuration && !isNumber) || (sort != VideoSortDuration && !isString) {
+		return videoCursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// UpdateUserProfileParams holds the profile fields to change. Nil fields
+// are left as they are.
+type UpdateUserProfileParams struct {
+	DisplayName *string
+	Bio         *string
+}
+
+func (c Client) UpdateUserProfile(id uuid.UUID, params UpdateUserProfileParams) error {
+	query := `
+		UPDATE users
+		SET
+			display_name = COALESCE(?, display_name),
+			bio = COALESCE(?, bio),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, params.DisplayName, params.Bio, id)
+	return err
+}
+
+// SetUserAvatar removes a user's avatar, or points it at a thumbnail
+// asset that's already referenced, and returns the previous avatar if
+// nothing references it anymore, which the caller should delete. New
+// avatars go through CommitAvatarUpload.
+func (c Client) SetUserAvatar(id uuid.UUID, key, url string) ([]Asset, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	previous, err := setUserAvatar(tx, id, key, url)
+	if err != nil {
+		return nil, err
+	}
+	err = retireAvatarUploads(tx, id, UploadStatusReleased)
+	if err != nil {
+		return nil, err
+	}
+	released, err := unreferencedAvatar(tx, previous)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+// CommitAvatarUpload finalizes a pending avatar upload: in one transaction
+// it marks the upload committed, supersedes the user's previous avatar
+// upload and points their avatar at the upload's asset, taking a reference
+// on it. It returns the previous avatar if nothing references it anymore,
+// which the caller should delete.
+func (c Client) CommitAvatarUpload(upload Upload, url string) ([]Asset, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = retireAvatarUploads(tx, upload.UserID, UploadStatusSuperseded)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(`
+	UPDATE uploads
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`, UploadStatusCommitted, upload.ID, UploadStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, errors.Join(errors.New("upload is no longer pending"), err)
+	}
+
+	previous, err := setUserAvatar(tx, upload.UserID, upload.Key, url)
+	if err != nil {
+		return nil, err
+	}
+	released, err := unreferencedAvatar(tx, previous)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+// setUserAvatar points a user's avatar at key, or removes it if key is
+// empty. The reference on the asset is held by the users row rather than
+// by the upload, so avatars set before uploads were recorded for them are
+// still counted. It returns the key of the previous avatar, if it changed.
+func setUserAvatar(tx *sql.Tx, id uuid.UUID, key, url string) (string, error) {
+	var previous sql.NullString
+	err := tx.QueryRow(`SELECT avatar_key FROM users WHERE id = ?`, id).Scan(&previous)
+	if err != nil {
+		return "", err
+	}
+	if previous.String == key {
+		return "", nil
+	}
+
+	if key != "" {
+		result, err := tx.Exec(`
+		UPDATE assets
+		SET ref_count = ref_count + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE kind = ? AND object_key = ?
+		`, UploadKindThumbnail, key)
+		if err != nil {
+			return "", err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return "", errors.Join(errors.New("avatar has no asset record"), err)
+		}
+	}
+	if previous.Valid {
+		_, err = tx.Exec(`
+		UPDATE assets
+		SET ref_count = ref_count - 1, updated_at = CURRENT_TIMESTAMP
+		WHERE kind = ? AND object_key = ? AND ref_count > 0
+		`, UploadKindThumbnail, previous.String)
+		if err != nil {
+			return "", err
+		}
+	}
+	_, err = tx.Exec(`
+		UPDATE users
+		SET avatar_key = NULLIF(?, ''), avatar_url = NULLIF(?, ''), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, key, url, id)
+	if err != nil {
+		return "", err
+	}
+	return previous.String, nil
+}
+
+// retireAvatarUploads moves a user's committed avatar upload to status.
+// Unlike releaseUploads it leaves the asset's references alone, since
+// setUserAvatar manages those.
+func retireAvatarUploads(tx *sql.Tx, userID uuid.UUID, status UploadStatus) error {
+	_, err := tx.Exec(`
+	UPDATE uploads
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND status = ?
+	`, status, userID, UploadStatusCommitted)
+	return err
+}
+
+// unreferencedAvatar returns the asset of a replaced avatar if nothing
+// references it anymore.
+func unreferencedAvatar(tx *sql.Tx, key string) ([]Asset, error) {
+	if key == "" {
+		return nil, nil
+	}
+	asset, err := getAsset(tx, UploadKindThumbnail, key)
+	if err != nil {
+		return nil, err
+	}
+	if asset.Key == "" || asset.RefCount > 0 {
+		return nil, nil
+	}
+	return []Asset{asset}, nil
+}
+
+// getAvatarKeys returns the thumbnail assets used as avatars.
+func getAvatarKeys(q querier) ([]string, error) {
+	rows, err := q.Query(`SELECT avatar_key FROM users WHERE avatar_key IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ChangePassword replaces a user's password and revokes every session but
+// keepSessionID, the one making the change. Outstanding reset links stop
+// working and any lockout is lifted.
+func (c Client) ChangePassword(id uuid.UUID, hashedPassword, keepSessionID string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET password = ?, failed_login_count = 0, locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, hashedPassword, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`, id, UserTokenResetPassword)
+	if err != nil {
+		return err
+	}
+	if err := revokeSessions(tx, "user_id = ? AND id != ?", id, keepSessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
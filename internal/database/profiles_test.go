@@ -0,0 +1,164 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func createTestAsset(t *testing.T, c Client, kind UploadKind, key string, size int64) {
+	t.Helper()
+	_, err := c.CreateAsset(CreateAssetParams{Kind: kind, Key: key, SHA256: key, Size: size, MediaType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stageTestUpload(t *testing.T, c Client, params CreateUploadParams) Upload {
+	t.Helper()
+	upload, err := c.CreateUpload(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upload
+}
+
+func checkRefCount(t *testing.T, c Client, kind UploadKind, key string, want int) {
+	t.Helper()
+	asset, err := c.GetAsset(kind, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asset.RefCount != want {
+		t.Errorf("%s ref_count = %d, want %d", key, asset.RefCount, want)
+	}
+}
+
+func checkUploadStatus(t *testing.T, c Client, id uuid.UUID, want UploadStatus) {
+	t.Helper()
+	upload, err := c.GetUpload(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Status != want {
+		t.Errorf("upload status = %q, want %q", upload.Status, want)
+	}
+}
+
+func assetKeys(assets []Asset) []string {
+	keys := []string{}
+	for _, asset := range assets {
+		keys = append(keys, asset.Key)
+	}
+	return keys
+}
+
+func TestCommitAvatarUpload(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	otherID := createTestUser(t, c, "other@example.com")
+	createTestAsset(t, c, UploadKindThumbnail, "a.png", 10)
+	createTestAsset(t, c, UploadKindThumbnail, "b.png", 10)
+
+	first := stageTestUpload(t, c, CreateUploadParams{UserID: userID, Kind: UploadKindThumbnail, Key: "a.png"})
+	released, err := c.CommitAvatarUpload(first, "http://localhost/assets/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 0 {
+		t.Errorf("first avatar released %v", assetKeys(released))
+	}
+	checkRefCount(t, c, UploadKindThumbnail, "a.png", 1)
+	checkUploadStatus(t, c, first.ID, UploadStatusCommitted)
+
+	if _, err := c.CommitAvatarUpload(first, "http://localhost/assets/a.png"); err == nil {
+		t.Error("committed the same upload twice")
+	}
+
+	// Another user with the same image shares the asset.
+	shared := stageTestUpload(t, c, CreateUploadParams{UserID: otherID, Kind: UploadKindThumbnail, Key: "a.png"})
+	if _, err := c.CommitAvatarUpload(shared, "http://localhost/assets/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	checkRefCount(t, c, UploadKindThumbnail, "a.png", 2)
+
+	second := stageTestUpload(t, c, CreateUploadParams{UserID: userID, Kind: UploadKindThumbnail, Key: "b.png"})
+	released, err = c.CommitAvatarUpload(second, "http://localhost/assets/b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 0 {
+		t.Errorf("replacing a shared avatar released %v", assetKeys(released))
+	}
+	checkRefCount(t, c, UploadKindThumbnail, "a.png", 1)
+	checkRefCount(t, c, UploadKindThumbnail, "b.png", 1)
+	checkUploadStatus(t, c, first.ID, UploadStatusSuperseded)
+	checkUploadStatus(t, c, second.ID, UploadStatusCommitted)
+
+	released, err = c.SetUserAvatar(otherID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := assetKeys(released); len(keys) != 1 || keys[0] != "a.png" {
+		t.Errorf("removing the last reference released %v, want [a.png]", keys)
+	}
+	checkRefCount(t, c, UploadKindThumbnail, "a.png", 0)
+	checkUploadStatus(t, c, shared.ID, UploadStatusReleased)
+
+	user, err := c.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.AvatarURL == nil || *user.AvatarURL != "http://localhost/assets/b.png" {
+		t.Errorf("avatar_url = %v", user.AvatarURL)
+	}
+}
+
+func TestMigrateAvatarUploads(t *testing.T) {
+	path := t.TempDir() + "/tubely.db"
+	c, err := NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := createTestVideo(t, c, createTestUser(t, c, "boots@example.com"), "Boots", "")
+	upload := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindVideo, Key: "v.mp4"})
+
+	// Put the table back the way it was before avatars were uploaded.
+	_, err = c.db.Exec(`
+	CREATE TABLE uploads_old (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		status TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	INSERT INTO uploads_old SELECT id, created_at, updated_at, video_id, kind, object_key, status FROM uploads;
+	DROP TABLE uploads;
+	ALTER TABLE uploads_old RENAME TO uploads;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.db.Close()
+
+	c, err = NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.db.Close()
+
+	got, err := c.GetUpload(upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VideoID != video.ID || got.Key != "v.mp4" || got.Status != UploadStatusPending {
+		t.Errorf("upload after migration = %+v", got)
+	}
+	avatar := stageTestUpload(t, c, CreateUploadParams{UserID: video.UserID, Kind: UploadKindThumbnail, Key: "a.png"})
+	if avatar.VideoID != uuid.Nil || avatar.UserID != video.UserID {
+		t.Errorf("avatar upload = %+v", avatar)
+	}
+}
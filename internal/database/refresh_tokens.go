@@ -2,62 +2,152 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrRefreshTokenInvalid is returned for refresh tokens that don't
+	// exist, have expired or have been revoked.
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+	// ErrRefreshTokenReused is returned when a refresh token that was
+	// already rotated is used again, which means it has leaked. Every token
+	// in its family is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token was reused")
+)
+
 type RefreshToken struct {
 	CreateRefreshTokenParams
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
-	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	ReplacedBy *string    `json:"-"`
 }
 
 type CreateRefreshTokenParams struct {
 	Token     string    `json:"token"`
 	UserID    uuid.UUID `json:"user_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// FamilyID links a token to the ones it was rotated from. It is the ID
+	// of the session the tokens belong to.
+	FamilyID string `json:"-"`
 }
 
-func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
+func createRefreshToken(db execer, params CreateRefreshTokenParams) error {
 	query := `
 		INSERT INTO refresh_tokens (
 			token,
 			created_at,
 			updated_at,
 			user_id,
-			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+			expires_at,
+			family_id
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt.UTC().Format(sqliteTimestampFormat), params.FamilyID)
+	return err
+}
+
+// RotateRefreshToken exchanges a valid refresh token for newToken, which
+// joins the same family and expires at expiresAt, and records the session
+// as used by client. The old token can't be used again: doing so returns
+// ErrRefreshTokenReused and revokes the whole session, forcing the user to
+// log in again.
+func (c Client) RotateRefreshToken(token, newToken string, expiresAt time.Time, client SessionClient) (RefreshToken, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	rt, err := getRefreshToken(tx, token)
 	if err != nil {
 		return RefreshToken{}, err
 	}
+	if rt.Token == "" {
+		return RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	if rt.ReplacedBy != nil {
+		return RefreshToken{}, revokeReusedFamily(tx, rt.FamilyID)
+	}
+	if rt.RevokedAt != nil || !time.Now().Before(rt.ExpiresAt) {
+		return RefreshToken{}, ErrRefreshTokenInvalid
+	}
 
-	return c.GetRefreshToken(params.Token)
+	// Another request may have rotated the token since it was read.
+	result, err := tx.Exec(`
+		UPDATE refresh_tokens
+		SET replaced_by = ?, revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE token = ? AND replaced_by IS NULL AND revoked_at IS NULL
+	`, newToken, token)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if n == 0 {
+		return RefreshToken{}, revokeReusedFamily(tx, rt.FamilyID)
+	}
+
+	err = createRefreshToken(tx, CreateRefreshTokenParams{
+		Token:     newToken,
+		UserID:    rt.UserID,
+		ExpiresAt: expiresAt,
+		FamilyID:  rt.FamilyID,
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	err = touchSession(tx, rt.FamilyID, expiresAt, client)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	rotated, err := getRefreshToken(tx, newToken)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return RefreshToken{}, err
+	}
+	return rotated, nil
+}
+
+// revokeReusedFamily revokes the session a family belongs to and commits,
+// returning ErrRefreshTokenReused on success.
+func revokeReusedFamily(tx *sql.Tx, familyID string) error {
+	err := revokeSessions(tx, "id = ?", familyID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
 }
 
+// RevokeRefreshToken logs out of the session a refresh token belongs to.
 func (c Client) RevokeRefreshToken(token string) error {
-	query := `
-		UPDATE refresh_tokens
-		SET revoked_at = CURRENT_TIMESTAMP
-		WHERE token = ?
-	`
-	_, err := c.db.Exec(query, token)
-	return err
+	return c.revokeSessions("id = (SELECT family_id FROM refresh_tokens WHERE token = ?)", token)
 }
 
 func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
+	return getRefreshToken(c.db, token)
+}
+
+func getRefreshToken(db queryExecer, token string) (RefreshToken, error) {
 	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
+		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at, family_id, replaced_by
 		FROM refresh_tokens
 		WHERE token = ?
 	`
 	var rt RefreshToken
 	var userID string
-	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+	err := db.QueryRow(query, token).
+		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt, &rt.FamilyID, &rt.ReplacedBy)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return RefreshToken{}, nil
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	expiresAt := time.Now().Add(time.Hour)
+	session, err := c.CreateSession(CreateSessionParams{UserID: userID, RefreshToken: "t1", ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := SessionClient{UserAgent: "test", IP: "192.0.2.1"}
+
+	rotated, err := c.RotateRefreshToken("t1", "t2", expiresAt, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Token != "t2" || rotated.UserID != userID || rotated.FamilyID != session.ID {
+		t.Errorf("rotated token = %+v, want t2 in session %s", rotated, session.ID)
+	}
+	if _, err := c.RotateRefreshToken("t2", "t3", expiresAt, client); err != nil {
+		t.Fatalf("rotating the new token: %v", err)
+	}
+
+	// Using a replaced token again logs the whole session out.
+	if _, err := c.RotateRefreshToken("t1", "t4", expiresAt, client); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing a token: error = %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := c.RotateRefreshToken("t3", "t5", expiresAt, client); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("rotating after reuse: error = %v, want ErrRefreshTokenInvalid", err)
+	}
+	got, err := c.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RevokedAt == nil {
+		t.Error("session wasn't revoked after a token was reused")
+	}
+}
+
+func TestRotateRefreshTokenInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		// setup runs before the token is rotated.
+		setup func(t *testing.T, c Client, session Session)
+		token string
+	}{
+		{
+			name:      "unknown",
+			expiresAt: time.Now().Add(time.Hour),
+			token:     "missing",
+		},
+		{
+			name:      "expired",
+			expiresAt: time.Now().Add(-time.Minute),
+			token:     "t1",
+		},
+		{
+			name:      "revoked session",
+			expiresAt: time.Now().Add(time.Hour),
+			setup: func(t *testing.T, c Client, session Session) {
+				if err := c.RevokeSession(session.ID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			token: "t1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			userID := createTestUser(t, c, "boots@example.com")
+			session, err := c.CreateSession(CreateSessionParams{UserID: userID, RefreshToken: "t1", ExpiresAt: tt.expiresAt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(t, c, session)
+			}
+			_, err = c.RotateRefreshToken(tt.token, "t2", time.Now().Add(time.Hour), SessionClient{})
+			if !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Errorf("error = %v, want ErrRefreshTokenInvalid", err)
+			}
+		})
+	}
+}
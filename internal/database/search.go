@@ -0,0 +1,288 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+var ErrEmptySearchQuery = errors.New("search query is empty")
+
+// errNoFTS5 means SQLite was built without the sqlite_fts5 tag.
+var errNoFTS5 = errors.New("SQLite was built without FTS5")
+
+// Highlighted spans are delimited with control characters inside SQLite and
+// only turned into markup after the surrounding text has been escaped, so
+// titles and descriptions can't inject HTML through the highlights.
+const (
+	highlightOpen  = "\x02"
+	highlightClose = "\x03"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+)
+
+type SearchVideosParams struct {
+	UserID uuid.UUID
+	Query  string
+	Limit  int
+}
+
+type VideoSearchResult struct {
+	Video
+	TitleHighlight     string  `json:"title_highlight"`
+	DescriptionSnippet string  `json:"description_snippet"`
+	Rank               float64 `json:"rank"`
+}
+
+// migrateSearchIndex creates the FTS5 index over video titles and
+// descriptions along with the triggers that keep it in sync. The index
+// stores its own copy of the text keyed by video ID rather than using the
+// videos table as external content, because videos has no INTEGER PRIMARY
+// KEY and VACUUM is free to renumber its rowids.
+//
+// Without FTS5 it drops the triggers instead and returns errNoFTS5. They
+// live in the database file, so one created by a build with FTS5 would
+// otherwise fail every write to videos. The index is rebuilt when the
+// triggers are next created, since it missed those writes.
+func (c *Client) migrateSearchIndex() error {
+	var fts5 bool
+	err := c.db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5)
+	if err != nil {
+		return err
+	}
+	if !fts5 {
+		_, err = c.db.Exec(`
+		DROP TRIGGER IF EXISTS videos_fts_insert;
+		DROP TRIGGER IF EXISTS videos_fts_update;
+		DROP TRIGGER IF EXISTS videos_fts_delete;
+		`)
+		if err != nil {
+			return err
+		}
+		return errNoFTS5
+	}
+
+	var synced int
+	err = c.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'videos_fts_insert'`).Scan(&synced)
+	if err != nil {
+		return err
+	}
+
+	searchIndex := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS videos_fts USING fts5(
+		video_id UNINDEXED,
+		title,
+		description,
+		tokenize = 'unicode61 remove_diacritics 2',
+		prefix = '2 3'
+	);
+	CREATE TRIGGER IF NOT EXISTS videos_fts_insert AFTER INSERT ON videos BEGIN
+		INSERT INTO videos_fts (video_id, title, description)
+		VALUES (new.id, new.title, coalesce(new.description, ''));
+	END;
+	CREATE TRIGGER IF NOT EXISTS videos_fts_update AFTER UPDATE OF title, description ON videos BEGIN
+		DELETE FROM videos_fts WHERE video_id = old.id;
+		INSERT INTO videos_fts (video_id, title, description)
+		VALUES (new.id, new.title, coalesce(new.description, ''));
+	END;
+	CREATE TRIGGER IF NOT EXISTS videos_fts_delete AFTER DELETE ON videos BEGIN
+		DELETE FROM videos_fts WHERE video_id = old.id;
+	END;
+	`
+	_, err = c.db.Exec(searchIndex)
+	if err != nil {
+		return err
+	}
+
+	if synced == 0 {
+		_, err = c.db.Exec(`
+		DELETE FROM videos_fts;
+		INSERT INTO videos_fts (video_id, title, description)
+		SELECT id, title, coalesce(description, '') FROM videos;
+		`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchTerms splits a user query into bare words, dropping anything that
+// FTS5 would interpret as query syntax.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// FullTextSearch reports whether search uses the FTS5 index rather than
+// LIKE matching.
+func (c Client) FullTextSearch() bool {
+	return c.fts
+}
+
+// SearchVideos finds a user's videos whose title or description contains
+// every word of the query, treating the last characters of each word as a
+// prefix. Title matches rank above description matches.
+func (c Client) SearchVideos(params SearchVideosParams) ([]VideoSearchResult, error) {
+	terms := searchTerms(params.Query)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearchQuery
+	}
+	if params.Limit <= 0 {
+		params.Limit = DefaultSearchLimit
+	}
+	if params.Limit > MaxSearchLimit {
+		params.Limit = MaxSearchLimit
+	}
+
+	if !c.fts {
+		return c.searchVideosLike(params.UserID, terms, params.Limit)
+	}
+
+	matches := make([]string, len(terms))
+	for i, term := range terms {
+		matches[i] = `"` + term + `"*`
+	}
+
+	query := `
+	SELECT` + videoColumns + `,
+		m.title_highlight,
+		m.description_snippet,
+		m.rank
+	FROM videos
+	JOIN (
+		SELECT
+			video_id,
+			highlight(videos_fts, 1, ?, ?) AS title_highlight,
+			snippet(videos_fts, 2, ?, ?, '…', 16) AS description_snippet,
+			bm25(videos_fts, 0.0, 10.0, 1.0) AS rank
+		FROM videos_fts
+		WHERE videos_fts MATCH ?
+	) AS m ON m.video_id = videos.id
+	WHERE videos.user_id = ? AND videos.deleted_at IS NULL
+	ORDER BY m.rank
+	LIMIT ?
+	`
+	rows, err := c.db.Query(
+		query,
+		highlightOpen, highlightClose,
+		highlightOpen, highlightClose,
+		strings.Join(matches, " "),
+		params.UserID,
+		params.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []VideoSearchResult{}
+	for rows.Next() {
+		var result VideoSearchResult
+		dest := append(videoFields(&result.Video),
+			&result.TitleHighlight,
+			&result.DescriptionSnippet,
+			&result.Rank,
+		)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result.TitleHighlight = renderHighlight(result.TitleHighlight)
+		result.DescriptionSnippet = renderHighlight(result.DescriptionSnippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// searchVideosLike is used when the SQLite driver was built without FTS5.
+// It matches the same words with LIKE and ranks title hits first.
+func (c Client) searchVideosLike(userID uuid.UUID, terms []string, limit int) ([]VideoSearchResult, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL
+	`
+	args := []any{userID}
+	titleHits := []string{}
+	for _, term := range terms {
+		pattern := "%" + term + "%"
+		query += "AND (title LIKE ? OR description LIKE ?)\n"
+		args = append(args, pattern, pattern)
+		titleHits = append(titleHits, "(title LIKE ?)")
+	}
+	for _, term := range terms {
+		args = append(args, "%"+term+"%")
+	}
+	query += fmt.Sprintf("ORDER BY %s DESC, created_at DESC\nLIMIT ?", strings.Join(titleHits, " + "))
+	args = append(args, limit)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []VideoSearchResult{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, VideoSearchResult{
+			Video:              video,
+			TitleHighlight:     renderHighlight(markTerms(video.Title, terms)),
+			DescriptionSnippet: renderHighlight(markTerms(video.Description, terms)),
+		})
+	}
+	return results, rows.Err()
+}
+
+// markTerms wraps case-insensitive occurrences of terms in highlight
+// delimiters, mirroring what FTS5's highlight() produces.
+func markTerms(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// Lowercasing changed byte offsets; don't risk splitting runes.
+		return text
+	}
+
+	marked := make([]bool, len(text))
+	for _, term := range terms {
+		term = strings.ToLower(term)
+		for i := 0; i+len(term) <= len(lower); {
+			j := strings.Index(lower[i:], term)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(term); k++ {
+				marked[k] = true
+			}
+			i += j + len(term)
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			b.WriteString(highlightOpen)
+		}
+		b.WriteByte(text[i])
+		if marked[i] && (i == len(text)-1 || !marked[i+1]) {
+			b.WriteString(highlightClose)
+		}
+	}
+	return b.String()
+}
+
+func renderHighlight(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, highlightOpen, "<mark>")
+	return strings.ReplaceAll(s, highlightClose, "</mark>")
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSearchVideos(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	otherID := createTestUser(t, c, "other@example.com")
+	createTestVideo(t, c, userID, "Boots the bear", "A bear named Boots goes fishing")
+	createTestVideo(t, c, userID, "Fishing trip", "Bears everywhere")
+	createTestVideo(t, c, userID, "Café <b>tour</b>", "Nothing to see")
+	createTestVideo(t, c, otherID, "Other bear", "Not yours")
+	trashed := createTestVideo(t, c, userID, "Trashed bear", "")
+	if err := c.TrashVideo(trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   string
+		want    []string
+		wantErr error
+	}{
+		{query: "bear", want: []string{"Boots the bear", "Fishing trip"}},
+		{query: "fish", want: []string{"Boots the bear", "Fishing trip"}},
+		{query: "boots fishing", want: []string{"Boots the bear"}},
+		{query: `"bo*" -fish`, want: []string{"Boots the bear"}},
+		{query: "tour", want: []string{"Café <b>tour</b>"}},
+		{query: "missing", want: []string{}},
+		{query: "  *  ", wantErr: ErrEmptySearchQuery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			results, err := c.SearchVideos(SearchVideosParams{UserID: userID, Query: tt.query})
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			titles := []string{}
+			for _, result := range results {
+				titles = append(titles, result.Title)
+			}
+			slices.Sort(titles)
+			if tt.wantErr == nil && !slices.Equal(titles, tt.want) {
+				t.Errorf("titles = %q, want %q", titles, tt.want)
+			}
+		})
+	}
+}
+
+// A database created by a build with FTS5 keeps the triggers that keep the
+// index in sync, which fail without the module.
+func TestSearchIndexTriggersWithoutFTS5(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tubely.db")
+	c, err := NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FullTextSearch() {
+		t.Skip("SQLite was built with FTS5")
+	}
+	_, err = c.db.Exec(`
+	CREATE TRIGGER videos_fts_insert AFTER INSERT ON videos BEGIN
+		INSERT INTO videos_fts (video_id, title, description)
+		VALUES (new.id, new.title, coalesce(new.description, ''));
+	END;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.db.Close()
+
+	c, err = NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.db.Close()
+	createTestVideo(t, c, createTestUser(t, c, "boots@example.com"), "Boots the bear", "")
+}
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is a login on one device. It lasts as long as the family of
+// refresh tokens issued for it, and revoking it revokes all of them.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+}
+
+// SessionClient describes the client a session is used from.
+type SessionClient struct {
+	UserAgent string
+	IP        string
+}
+
+type CreateSessionParams struct {
+	UserID       uuid.UUID
+	RefreshToken string
+	ExpiresAt    time.Time
+	SessionClient
+}
+
+// maxUserAgentLength keeps clients from storing arbitrary amounts of data
+// in the sessions table.
+const maxUserAgentLength = 512
+
+func (sc SessionClient) userAgent() string {
+	if len(sc.UserAgent) > maxUserAgentLength {
+		return sc.UserAgent[:maxUserAgentLength]
+	}
+	return sc.UserAgent
+}
+
+const sessionColumns = `id, user_id, created_at, last_used_at, expires_at, revoked_at, user_agent, ip`
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.ExpiresAt,
+		&session.RevokedAt,
+		&session.UserAgent,
+		&session.IP,
+	)
+	return session, err
+}
+
+// CreateSession starts a session along with the first refresh token of its
+// family.
+func (c Client) CreateSession(params CreateSessionParams) (Session, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	id := uuid.New().String()
+	query := `
+	INSERT INTO sessions (
+		id,
+		user_id,
+		created_at,
+		last_used_at,
+		expires_at,
+		user_agent,
+		ip
+	) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	_, err = tx.Exec(query,
+		id,
+		params.UserID,
+		params.ExpiresAt.UTC().Format(sqliteTimestampFormat),
+		params.userAgent(),
+		params.IP,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+
+	err = createRefreshToken(tx, CreateRefreshTokenParams{
+		Token:     params.RefreshToken,
+		UserID:    params.UserID,
+		ExpiresAt: params.ExpiresAt,
+		FamilyID:  id,
+	})
+	if err != nil {
+		return Session{}, err
+	}
+
+	session, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if err != nil {
+		return Session{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// touchSession records that a session was used and extends it to
+// expiresAt.
+func touchSession(db execer, id string, expiresAt time.Time, client SessionClient) error {
+	query := `
+	UPDATE sessions
+	SET
+		last_used_at = CURRENT_TIMESTAMP,
+		expires_at = ?,
+		user_agent = ?,
+		ip = ?
+	WHERE id = ?
+	`
+	_, err := db.Exec(query, expiresAt.UTC().Format(sqliteTimestampFormat), client.userAgent(), client.IP, id)
+	return err
+}
+
+// GetSession returns a session, revoked or not.
+func (c Client) GetSession(id string) (Session, error) {
+	session, err := scanSession(c.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, nil
+	}
+	return session, err
+}
+
+// GetSessions returns a user's active sessions, most recently used first.
+func (c Client) GetSessions(userID uuid.UUID) ([]Session, error) {
+	query := `
+	SELECT ` + sessionColumns + `
+	FROM sessions
+	WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+	ORDER BY last_used_at DESC, id
+	`
+	rows, err := c.db.Query(query, userID, time.Now().UTC().Format(sqliteTimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends a session and every refresh token issued for it.
+func (c Client) RevokeSession(id string) error {
+	return c.revokeSessions("id = ?", id)
+}
+
+// RevokeUserSessions ends every session a user has, logging them out
+// everywhere.
+func (c Client) RevokeUserSessions(userID uuid.UUID) error {
+	return c.revokeSessions("user_id = ?", userID)
+}
+
+func (c Client) revokeSessions(where string, args ...any) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSessions(tx, where, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func revokeSessions(tx *sql.Tx, where string, args ...any) error {
+	query := `
+	UPDATE refresh_tokens
+	SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE revoked_at IS NULL AND family_id IN (SELECT id FROM sessions WHERE ` + where + `)
+	`
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	query = `
+	UPDATE sessions
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE revoked_at IS NULL AND ` + where
+	_, err := tx.Exec(query, args...)
+	return err
+}
@@ -0,0 +1,39 @@
+package database
+
+// SystemStats summarizes what the system holds.
+type SystemStats struct {
+	Users          int64 `json:"users"`
+	DisabledUsers  int64 `json:"disabled_users"`
+	Videos         int64 `json:"videos"`
+	TrashedVideos  int64 `json:"trashed_videos"`
+	Assets         int64 `json:"assets"`
+	AssetBytes     int64 `json:"asset_bytes"`
+	PendingUploads int64 `json:"pending_uploads"`
+	ActiveSessions int64 `json:"active_sessions"`
+}
+
+func (c Client) GetSystemStats() (SystemStats, error) {
+	query := `
+	SELECT
+		(SELECT count(*) FROM users),
+		(SELECT count(*) FROM users WHERE disabled_at IS NOT NULL),
+		(SELECT count(*) FROM videos WHERE deleted_at IS NULL),
+		(SELECT count(*) FROM videos WHERE deleted_at IS NOT NULL),
+		(SELECT count(*) FROM assets),
+		(SELECT coalesce(sum(size), 0) FROM assets),
+		(SELECT count(*) FROM uploads WHERE status = 'pending'),
+		(SELECT count(*) FROM sessions WHERE revoked_at IS NULL AND expires_at > strftime('%Y-%m-%d %H:%M:%S', 'now'))
+	`
+	var stats SystemStats
+	err := c.db.QueryRow(query).Scan(
+		&stats.Users,
+		&stats.DisabledUsers,
+		&stats.Videos,
+		&stats.TrashedVideos,
+		&stats.Assets,
+		&stats.AssetBytes,
+		&stats.PendingUploads,
+		&stats.ActiveSessions,
+	)
+	return stats, err
+}
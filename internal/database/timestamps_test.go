@@ -0,0 +1,80 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTimestampFormat checks that expiry times are stored the way SQLite
+// writes CURRENT_TIMESTAMP, so comparing them in SQL works.
+func TestTimestampFormat(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	expiresAt := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		write  func() error
+		table  string
+		column string
+	}{
+		{
+			name: "user token",
+			write: func() error {
+				return c.CreateUserToken(CreateUserTokenParams{
+					UserID: userID, Purpose: UserTokenVerifyEmail, Email: "boots@example.com", Hash: "hash", ExpiresAt: expiresAt,
+				})
+			},
+			table:  "user_tokens",
+			column: "expires_at",
+		},
+		{
+			name: "OIDC state",
+			write: func() error {
+				return c.CreateOIDCState("state", OIDCState{Nonce: "nonce", CodeVerifier: "verifier", ExpiresAt: expiresAt})
+			},
+			table:  "oidc_states",
+			column: "expires_at",
+		},
+		{
+			name:   "MFA challenge",
+			write:  func() error { return c.CreateMFAChallenge(userID, "hash", expiresAt) },
+			table:  "mfa_challenges",
+			column: "expires_at",
+		},
+		{
+			name: "session",
+			write: func() error {
+				_, err := c.CreateSession(CreateSessionParams{UserID: userID, RefreshToken: "token", ExpiresAt: expiresAt})
+				return err
+			},
+			table:  "refresh_tokens",
+			column: "expires_at",
+		},
+		{
+			name: "lockout",
+			write: func() error {
+				_, err := c.RecordLoginFailure(userID, 10, func(int) time.Duration { return time.Minute })
+				return err
+			},
+			table:  "users",
+			column: "locked_until",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.write(); err != nil {
+				t.Fatal(err)
+			}
+			var ok bool
+			query := "SELECT " + tt.column + " = strftime('%Y-%m-%d %H:%M:%S', " + tt.column + ") FROM " + tt.table
+			err := c.db.QueryRow(query).Scan(&ok)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Errorf("%s.%s isn't stored as %q", tt.table, tt.column, sqliteTimestampFormat)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadKind identifies which storage backend an upload's object lives in.
+type UploadKind string
+
+const (
+	UploadKindVideo     UploadKind = "video"
+	UploadKindThumbnail UploadKind = "thumbnail"
+)
+
+// UploadStatus tracks an upload through finalization. A row is created as
+// pending before its object is written, so an object can always be traced
+// back to the upload that produced it even if the process dies midway.
+type UploadStatus string
+
+const (
+	UploadStatusPending    UploadStatus = "pending"
+	UploadStatusCommitted  UploadStatus = "committed"
+	UploadStatusFailed     UploadStatus = "failed"
+	UploadStatusSuperseded UploadStatus = "superseded"
+	// UploadStatusReleased marks the uploads of a video being purged.
+	UploadStatusReleased UploadStatus = "released"
+)
+
+type Upload struct {
+	ID        uuid.UUID    `json:"id"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	Status    UploadStatus `json:"status"`
+	CreateUploadParams
+}
+
+// CreateUploadParams describes an upload of a video's file, or of a
+// user's avatar when UserID is set instead of VideoID.
+type CreateUploadParams struct {
+	VideoID uuid.UUID  `json:"video_id"`
+	UserID  uuid.UUID  `json:"user_id"`
+	Kind    UploadKind `json:"kind"`
+	Key     string     `json:"key"`
+}
+
+const uploadColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		kind,
+		object_key,
+		status`
+
+func scanUpload(row rowScanner) (Upload, error) {
+	var upload Upload
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.Kind,
+		&upload.Key,
+		&upload.Status,
+	)
+	return upload, err
+}
+
+func (c Client) CreateUpload(params CreateUploadParams) (Upload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO uploads (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		kind,
+		object_key,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		id,
+		nullUUID(params.VideoID),
+		nullUUID(params.UserID),
+		params.Kind,
+		params.Key,
+		UploadStatusPending,
+	)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	return c.GetUpload(id)
+}
+
+func (c Client) GetUpload(id uuid.UUID) (Upload, error) {
+	query := `
+	SELECT` + uploadColumns + `
+	FROM uploads
+	WHERE id = ?
+	`
+	upload, err := scanUpload(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Upload{}, nil
+		}
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// GetVideoUploads returns every upload recorded for a video, in the order
+// they were started.
+func (c Client) GetVideoUploads(videoID uuid.UUID) ([]Upload, error) {
+	query := `
+	SELECT` + uploadColumns + `
+	FROM uploads
+	WHERE video_id = ?
+	ORDER BY created_at
+	`
+	return queryUploads(c.db, query, videoID)
+}
+
+// GetPendingUploads returns uploads that were started before the given time
+// and never finalized.
+func (c Client) GetPendingUploads(startedBefore time.Time) ([]Upload, error) {
+	return getPendingUploads(c.db, startedBefore)
+}
+
+func getPendingUploads(q querier, startedBefore time.Time) ([]Upload, error) {
+	query := `
+	SELECT` + uploadColumns + `
+	FROM uploads
+	WHERE status = ? AND created_at < ?
+	ORDER BY created_at
+	`
+	return queryUploads(q, query, UploadStatusPending, startedBefore.UTC().Format(sqliteTimestampFormat))
+}
+
+func queryUploads(q querier, query string, args ...any) ([]Upload, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []Upload{}
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// CommitUpload finalizes a pending upload: in one transaction it writes
+// the video row (failing with ErrVideoVersionConflict if it changed since
+// it was read), marks the upload committed, takes a reference on its
+// asset, supersedes the upload it replaces and updates the owner's usage.
+// It returns the committed video and the replaced assets that are no
+// longer referenced by anything, which the caller should delete. Both are
+// read before committing, so the commit is the last thing that can fail.
+func (c Client) CommitUpload(upload Upload, video Video) (Video, []Asset, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Video{}, nil, err
+	}
+	defer tx.Rollback()
+
+	err = ensureUsage(tx, video.UserID)
+	if err != nil {
+		return Video{}, nil, err
+	}
+
+	err = updateVideo(tx, video)
+	if err != nil {
+		return Video{}, nil, err
+	}
+
+	replacedBytes, err := committedBytes(tx, "u.video_id = ? AND u.kind = ?", upload.VideoID, upload.Kind)
+	if err != nil {
+		return Video{}, nil, err
+	}
+	err = releaseUploads(tx, "video_id = ? AND kind = ?", UploadStatusSuperseded, upload.VideoID, upload.Kind)
+	if err != nil {
+		return Video{}, nil, err
+	}
+
+	result, err := tx.Exec(`
+	UPDATE uploads
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`, UploadStatusCommitted, upload.ID, UploadStatusPending)
+	if err != nil {
+		return Video{}, nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return Video{}, nil, errors.Join(errors.New("upload is no longer pending"), err)
+	}
+
+	result, err = tx.Exec(`
+	UPDATE assets
+	SET ref_count = ref_count + 1, updated_at = CURRENT_TIMESTAMP
+	WHERE kind = ? AND object_key = ?
+	`, upload.Kind, upload.Key)
+	if err != nil {
+		return Video{}, nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return Video{}, nil, errors.Join(errors.New("upload has no asset record"), err)
+	}
+
+	var size int64
+	err = tx.QueryRow(`SELECT size FROM assets WHERE kind = ? AND object_key = ?`, upload.Kind, upload.Key).Scan(&size)
+	if err != nil {
+		return Video{}, nil, err
+	}
+	err = addUsage(tx, video.UserID, usageDelta{
+		bytes:       size - replacedBytes,
+		uploadBytes: size,
+	})
+	if err != nil {
+		return Video{}, nil, err
+	}
+
+	released, err := unreferencedAssets(tx,
+		"u.video_id = ? AND u.kind = ? AND u.status = ?",
+		upload.VideoID, upload.Kind, UploadStatusSuperseded,
+	)
+	if err != nil {
+		return Video{}, nil, err
+	}
+	committed, err := getVideo(tx, video.ID)
+	if err != nil {
+		return Video{}, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Video{}, nil, err
+	}
+	return committed, released, nil
+}
+
+// nullUUID stores uuid.Nil as NULL.
+func nullUUID(id uuid.UUID) any {
+	if id == uuid.Nil {
+		return nil
+	}
+	return id
+}
+
+func (c Client) FailUpload(id uuid.UUID) error {
+	query := `
+	UPDATE uploads
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`
+	_, err := c.db.Exec(query, UploadStatusFailed, id, UploadStatusPending)
+	return err
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func commitTestUpload(t *testing.T, c Client, upload Upload, video Video) (Video, []Asset) {
+	t.Helper()
+	key := upload.Key
+	video.VideoURL = &key
+	video, released, err := c.CommitUpload(upload, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video, released
+}
+
+func checkUsage(t *testing.T, c Client, userID uuid.UUID, want Usage) {
+	t.Helper()
+	usage, err := c.GetUsage(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.UploadMonth = currentUploadMonth()
+	if usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+}
+
+func TestCommitUpload(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	video := createTestVideo(t, c, userID, "Boots", "")
+	createTestAsset(t, c, UploadKindVideo, "a.mp4", 100)
+	createTestAsset(t, c, UploadKindVideo, "b.mp4", 200)
+
+	first := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindVideo, Key: "a.mp4"})
+	checkUploadStatus(t, c, first.ID, UploadStatusPending)
+	checkRefCount(t, c, UploadKindVideo, "a.mp4", 0)
+
+	committed, released := commitTestUpload(t, c, first, video)
+	if len(released) != 0 {
+		t.Errorf("first upload released %v", assetKeys(released))
+	}
+	if committed.Version != video.Version+1 || committed.VideoURL == nil || *committed.VideoURL != "a.mp4" {
+		t.Errorf("committed video = version %d, URL %v", committed.Version, committed.VideoURL)
+	}
+	checkUploadStatus(t, c, first.ID, UploadStatusCommitted)
+	checkRefCount(t, c, UploadKindVideo, "a.mp4", 1)
+	checkUsage(t, c, userID, Usage{BytesStored: 100, VideoCount: 1, MonthlyUploadBytes: 100})
+
+	// A commit against the video as it was before the first one loses.
+	second := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindVideo, Key: "b.mp4"})
+	if _, _, err := c.CommitUpload(second, video); !errors.Is(err, ErrVideoVersionConflict) {
+		t.Fatalf("stale commit error = %v, want ErrVideoVersionConflict", err)
+	}
+	checkUploadStatus(t, c, second.ID, UploadStatusPending)
+	checkRefCount(t, c, UploadKindVideo, "b.mp4", 0)
+	checkUsage(t, c, userID, Usage{BytesStored: 100, VideoCount: 1, MonthlyUploadBytes: 100})
+
+	// Replacing the video releases the first upload's asset.
+	committed, released = commitTestUpload(t, c, second, committed)
+	if !slices.Equal(assetKeys(released), []string{"a.mp4"}) {
+		t.Errorf("replacing released %v, want [a.mp4]", assetKeys(released))
+	}
+	checkUploadStatus(t, c, first.ID, UploadStatusSuperseded)
+	checkUploadStatus(t, c, second.ID, UploadStatusCommitted)
+	checkRefCount(t, c, UploadKindVideo, "a.mp4", 0)
+	checkRefCount(t, c, UploadKindVideo, "b.mp4", 1)
+	checkUsage(t, c, userID, Usage{BytesStored: 200, VideoCount: 1, MonthlyUploadBytes: 300})
+
+	if _, _, err := c.CommitUpload(second, committed); err == nil {
+		t.Error("committed the same upload twice")
+	}
+}
+
+func TestCommitUploadSharedAsset(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	first := createTestVideo(t, c, userID, "First", "")
+	second := createTestVideo(t, c, userID, "Second", "")
+	createTestAsset(t, c, UploadKindThumbnail, "shared.png", 10)
+	createTestAsset(t, c, UploadKindThumbnail, "other.png", 20)
+
+	for _, video := range []Video{first, second} {
+		upload := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindThumbnail, Key: "shared.png"})
+		commitTestUpload(t, c, upload, video)
+	}
+	checkRefCount(t, c, UploadKindThumbnail, "shared.png", 2)
+	// Usage counts the content once for each video using it.
+	checkUsage(t, c, userID, Usage{BytesStored: 20, VideoCount: 2, MonthlyUploadBytes: 20})
+
+	first, err := c.GetVideo(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := stageTestUpload(t, c, CreateUploadParams{VideoID: first.ID, Kind: UploadKindThumbnail, Key: "other.png"})
+	_, released := commitTestUpload(t, c, upload, first)
+	if len(released) != 0 {
+		t.Errorf("replacing a shared asset released %v", assetKeys(released))
+	}
+	checkRefCount(t, c, UploadKindThumbnail, "shared.png", 1)
+	checkUsage(t, c, userID, Usage{BytesStored: 30, VideoCount: 2, MonthlyUploadBytes: 40})
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Usage is what a user currently consumes. BytesStored counts each video's
+// objects once per video, even when identical content is shared.
+type Usage struct {
+	BytesStored        int64  `json:"bytes_stored"`
+	VideoCount         int64  `json:"video_count"`
+	UploadMonth        string `json:"month"`
+	MonthlyUploadBytes int64  `json:"monthly_upload_bytes"`
+}
+
+// Quota limits a user's usage. Nil fields fall back to the configured
+// defaults, and a limit of zero means unlimited.
+type Quota struct {
+	Bytes              *int64 `json:"bytes"`
+	Videos             *int64 `json:"videos"`
+	MonthlyUploadBytes *int64 `json:"monthly_upload_bytes"`
+}
+
+// usageDelta is a change applied to a user's usage.
+type usageDelta struct {
+	bytes       int64
+	videos      int64
+	uploadBytes int64
+}
+
+func currentUploadMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+type queryExecer interface {
+	execer
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// ensureUsage creates a user's usage row if missing, computing it from the
+// data they already have so users predating usage accounting start out
+// with accurate numbers.
+func ensureUsage(db queryExecer, userID uuid.UUID) error {
+	query := `
+	INSERT OR IGNORE INTO user_usage (
+		user_id,
+		bytes_stored,
+		video_count,
+		upload_month,
+		monthly_upload_bytes,
+		updated_at
+	) SELECT
+		?,
+		(
+			SELECT coalesce(sum(a.size), 0)
+			FROM uploads u
+			JOIN videos v ON v.id = u.video_id
+			JOIN assets a ON a.kind = u.kind AND a.object_key = u.object_key
+			WHERE v.user_id = ? AND u.status = 'committed'
+		),
+		(SELECT count(*) FROM videos WHERE user_id = ?),
+		?,
+		0,
+		CURRENT_TIMESTAMP
+	`
+	_, err := db.Exec(query, userID, userID, userID, currentUploadMonth())
+	return err
+}
+
+// addUsage applies delta to a user's usage. The monthly upload counter
+// starts over when the month changes.
+func addUsage(db queryExecer, userID uuid.UUID, delta usageDelta) error {
+	if err := ensureUsage(db, userID); err != nil {
+		return err
+	}
+	query := `
+	UPDATE user_usage
+	SET
+		bytes_stored = max(0, bytes_stored + ?),
+		video_count = max(0, video_count + ?),
+		monthly_upload_bytes = CASE
+			WHEN upload_month = ? THEN monthly_upload_bytes + ?
+			ELSE ?
+		END,
+		upload_month = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = ?
+	`
+	month := currentUploadMonth()
+	_, err := db.Exec(query,
+		delta.bytes,
+		delta.videos,
+		month, delta.uploadBytes,
+		delta.uploadBytes,
+		month,
+		userID,
+	)
+	return err
+}
+
+// committedBytes sums the sizes of the objects held by the committed
+// uploads matching where.
+func committedBytes(db queryExecer, where string, args ...any) (int64, error) {
+	query := `
+	SELECT coalesce(sum(a.size), 0)
+	FROM uploads u
+	JOIN assets a ON a.kind = u.kind AND a.object_key = u.object_key
+	WHERE u.status = 'committed' AND ` + where
+	var bytes int64
+	err := db.QueryRow(query, args...).Scan(&bytes)
+	return bytes, err
+}
+
+// GetCommittedBytes returns the size of what a video currently holds for
+// kind, which is what a new upload of that kind would replace.
+func (c Client) GetCommittedBytes(videoID uuid.UUID, kind UploadKind) (int64, error) {
+	return committedBytes(c.db, "u.video_id = ? AND u.kind = ?", videoID, kind)
+}
+
+// GetUsage returns a user's current usage.
+func (c Client) GetUsage(userID uuid.UUID) (Usage, error) {
+	if err := ensureUsage(c.db, userID); err != nil {
+		return Usage{}, err
+	}
+	query := `
+	SELECT bytes_stored, video_count, upload_month, monthly_upload_bytes
+	FROM user_usage
+	WHERE user_id = ?
+	`
+	var usage Usage
+	err := c.db.QueryRow(query, userID).Scan(
+		&usage.BytesStored,
+		&usage.VideoCount,
+		&usage.UploadMonth,
+		&usage.MonthlyUploadBytes,
+	)
+	if err != nil {
+		return Usage{}, err
+	}
+	if usage.UploadMonth != currentUploadMonth() {
+		usage.UploadMonth = currentUploadMonth()
+		usage.MonthlyUploadBytes = 0
+	}
+	return usage, nil
+}
+
+// GetQuota returns a user's quota overrides.
+func (c Client) GetQuota(userID uuid.UUID) (Quota, error) {
+	query := `
+	SELECT quota_bytes, quota_videos, quota_monthly_upload_bytes
+	FROM users
+	WHERE id = ?
+	`
+	var quota Quota
+	err := c.db.QueryRow(query, userID).Scan(&quota.Bytes, &quota.Videos, &quota.MonthlyUploadBytes)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Quota{}, err
+	}
+	return quota, nil
+}
+
+// SetQuota overrides a user's quota. Nil fields reset to the default.
+func (c Client) SetQuota(userID uuid.UUID, quota Quota) error {
+	query := `
+	UPDATE users
+	SET
+		quota_bytes = ?,
+		quota_videos = ?,
+		quota_monthly_upload_bytes = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, quota.Bytes, quota.Videos, quota.MonthlyUploadBytes, userID)
+	return err
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+
+	quota, err := c.GetQuota(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota != (Quota{}) {
+		t.Errorf("new user's quota = %+v, want the defaults", quota)
+	}
+
+	bytes, videos := int64(1<<30), int64(0)
+	if err := c.SetQuota(userID, Quota{Bytes: &bytes, Videos: &videos}); err != nil {
+		t.Fatal(err)
+	}
+	quota, err = c.GetQuota(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Bytes == nil || *quota.Bytes != bytes || quota.Videos == nil || *quota.Videos != 0 || quota.MonthlyUploadBytes != nil {
+		t.Errorf("quota = %+v, want %d bytes, unlimited videos and the default monthly limit", quota, bytes)
+	}
+
+	if err := c.SetQuota(userID, Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	quota, err = c.GetQuota(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota != (Quota{}) {
+		t.Errorf("reset quota = %+v, want the defaults", quota)
+	}
+}
+
+func TestUsageMonthRollover(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	video := createTestVideo(t, c, userID, "Boots", "")
+	createTestAsset(t, c, UploadKindVideo, "a.mp4", 100)
+	upload := stageTestUpload(t, c, CreateUploadParams{VideoID: video.ID, Kind: UploadKindVideo, Key: "a.mp4"})
+	commitTestUpload(t, c, upload, video)
+
+	if _, err := c.db.Exec(`UPDATE user_usage SET upload_month = '2000-01' WHERE user_id = ?`, userID); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, c, userID, Usage{BytesStored: 100, VideoCount: 1, MonthlyUploadBytes: 0})
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// userTables are the tables with rows belonging to a user, other than
+// videos, which have stored objects to delete first.
+var userTables = []string{
+	"refresh_tokens",
+	"sessions",
+	"api_keys",
+	"user_tokens",
+	"recovery_codes",
+	"mfa_challenges",
+	"auth_events",
+	"user_identities",
+	"user_usage",
+	"uploads",
+}
+
+// ScheduleUserDeletion marks a user for deletion. They're disabled with
+// their sessions and API keys revoked, and their videos are moved to the
+// trash so they stop being shown straight away. DeleteUser finishes the
+// job once the videos are gone.
+func (c Client) ScheduleUserDeletion(id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET
+			deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP),
+			disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, id)
+	if err != nil {
+		return err
+	}
+	if err := revokeSessions(tx, "user_id = ?", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE api_keys
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+	`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE videos
+		SET deleted_at = CURRENT_TIMESTAMP, version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND deleted_at IS NULL
+	`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetDeletedUsers returns the users waiting to be deleted, oldest request
+// first.
+func (c Client) GetDeletedUsers() ([]User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetUserVideos returns every video a user owns, including those in the
+// trash.
+func (c Client) GetUserVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	ORDER BY created_at
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// DeleteUser permanently removes a user and everything that refers to
+// them. Their videos have to be deleted first, along with their objects.
+func (c Client) DeleteUser(id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var videos int
+	err = tx.QueryRow(`SELECT count(*) FROM videos WHERE user_id = ?`, id).Scan(&videos)
+	if err != nil {
+		return err
+	}
+	if videos > 0 {
+		return fmt.Errorf("user still has %d videos", videos)
+	}
+
+	for _, table := range userTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", id); err != nil {
+			return fmt.Errorf("couldn't delete from %s: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
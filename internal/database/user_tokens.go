@@ -0,0 +1,235 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserTokenPurpose is what a token sent to a user's email address can be
+// used for.
+type UserTokenPurpose string
+
+const (
+	UserTokenVerifyEmail   UserTokenPurpose = "verify_email"
+	UserTokenResetPassword UserTokenPurpose = "reset_password"
+	// UserTokenOIDCLogin hands a single sign-on login from the provider's
+	// redirect to the app, which swaps it for access and refresh tokens.
+	UserTokenOIDCLogin UserTokenPurpose = "oidc_login"
+	// UserTokenChangeEmail is sent to the address a user wants to change
+	// to, which replaces their current one once they follow the link.
+	UserTokenChangeEmail UserTokenPurpose = "change_email"
+)
+
+var (
+	// ErrUserTokenInvalid is returned for tokens that don't exist, have
+	// expired, have been used or were sent to an address the user no
+	// longer has.
+	ErrUserTokenInvalid = errors.New("token is invalid")
+	// ErrEmailTaken is returned when changing to an address another
+	// account has.
+	ErrEmailTaken = errors.New("email address is taken")
+)
+
+// CreateUserTokenParams describes a single-use token mailed to Email. Only
+// a hash of the token is stored.
+type CreateUserTokenParams struct {
+	UserID    uuid.UUID
+	Purpose   UserTokenPurpose
+	Email     string
+	Hash      string
+	ExpiresAt time.Time
+}
+
+func (c Client) CreateUserToken(params CreateUserTokenParams) error {
+	query := `
+		INSERT INTO user_tokens (
+			token_hash,
+			user_id,
+			purpose,
+			email,
+			created_at,
+			expires_at
+		) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.Exec(query, params.Hash, params.UserID, params.Purpose, params.Email, params.ExpiresAt.UTC().Format(sqliteTimestampFormat))
+	return err
+}
+
+// useUserToken marks a token as used and returns who it was for and the
+// address it was sent to.
+func useUserToken(tx *sql.Tx, hash string, purpose UserTokenPurpose) (uuid.UUID, string, error) {
+	var (
+		userID    uuid.UUID
+		email     string
+		expiresAt time.Time
+		usedAt    *time.Time
+	)
+	err := tx.QueryRow(`
+		SELECT user_id, email, expires_at, used_at
+		FROM user_tokens
+		WHERE token_hash = ? AND purpose = ?
+	`, hash, purpose).Scan(&userID, &email, &expiresAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, "", ErrUserTokenInvalid
+	}
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if usedAt != nil || !time.Now().Before(expiresAt) {
+		return uuid.Nil, "", ErrUserTokenInvalid
+	}
+
+	// Another request may have used the token since it was read.
+	result, err := tx.Exec(`
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND used_at IS NULL
+	`, hash)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if n == 0 {
+		return uuid.Nil, "", ErrUserTokenInvalid
+	}
+	return userID, email, nil
+}
+
+// updateUserWithEmail runs an update against a user only if they still
+// have the email address a token was sent to, returning
+// ErrUserTokenInvalid if they don't.
+func updateUserWithEmail(tx *sql.Tx, set string, id uuid.UUID, email string, args ...any) error {
+	args = append(args, id, email)
+	result, err := tx.Exec(`
+		UPDATE users
+		SET `+set+`, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND email = ?
+	`, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserTokenInvalid
+	}
+	return nil
+}
+
+// VerifyEmail uses a verification token, marking the address it was sent
+// to as verified.
+func (c Client) VerifyEmail(hash string) (uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := useUserToken(tx, hash, UserTokenVerifyEmail)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	err = updateUserWithEmail(tx, "email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)", userID, email)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return userID, tx.Commit()
+}
+
+// ResetPassword uses a password reset token to replace the user's password.
+// Their other reset tokens stop working and every session is revoked, so
+// whoever knew the old password is logged out. Receiving the token also
+// proves the user owns their email address, and lifts any lockout.
+func (c Client) ResetPassword(hash, hashedPassword string) (uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := useUserToken(tx, hash, UserTokenResetPassword)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	err = updateUserWithEmail(tx, "password = ?, email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP), failed_login_count = 0, locked_until = NULL", userID, email, hashedPassword)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`, userID, UserTokenResetPassword)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if err := revokeSessions(tx, "user_id = ?", userID); err != nil {
+		return uuid.Nil, err
+	}
+	return userID, tx.Commit()
+}
+
+// UseOIDCLoginToken uses a single sign-on login token, returning the user
+// it was issued to.
+func (c Client) UseOIDCLoginToken(hash string) (uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	userID, _, err := useUserToken(tx, hash, UserTokenOIDCLogin)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return userID, tx.Commit()
+}
+
+// ChangeEmail uses an email change token, replacing the user's address with
+// the one it was sent to, which is then verified. Their other email change
+// tokens stop working.
+func (c Client) ChangeEmail(hash string) (uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := useUserToken(tx, hash, UserTokenChangeEmail)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	var taken bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ? AND id != ?)`, email, userID).Scan(&taken)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if taken {
+		return uuid.Nil, ErrEmailTaken
+	}
+	_, err = tx.Exec(`
+		UPDATE users
+		SET email = ?, email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, email, userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`, userID, UserTokenChangeEmail)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return userID, tx.Commit()
+}
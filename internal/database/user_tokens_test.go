@@ -0,0 +1,132 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUseUserToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		purpose   UserTokenPurpose
+		expiresAt time.Time
+		// use uses the token, which was issued for purpose.
+		use     func(c Client) (uuid.UUID, error)
+		wantErr error
+	}{
+		{
+			name:      "verify email",
+			purpose:   UserTokenVerifyEmail,
+			expiresAt: time.Now().Add(time.Hour),
+			use:       func(c Client) (uuid.UUID, error) { return c.VerifyEmail("hash") },
+		},
+		{
+			name:      "expired",
+			purpose:   UserTokenVerifyEmail,
+			expiresAt: time.Now().Add(-time.Minute),
+			use:       func(c Client) (uuid.UUID, error) { return c.VerifyEmail("hash") },
+			wantErr:   ErrUserTokenInvalid,
+		},
+		{
+			name:      "another purpose",
+			purpose:   UserTokenOIDCLogin,
+			expiresAt: time.Now().Add(time.Hour),
+			use:       func(c Client) (uuid.UUID, error) { return c.VerifyEmail("hash") },
+			wantErr:   ErrUserTokenInvalid,
+		},
+		{
+			name:      "unknown",
+			purpose:   UserTokenVerifyEmail,
+			expiresAt: time.Now().Add(time.Hour),
+			use:       func(c Client) (uuid.UUID, error) { return c.VerifyEmail("other") },
+			wantErr:   ErrUserTokenInvalid,
+		},
+		{
+			name:      "OIDC login",
+			purpose:   UserTokenOIDCLogin,
+			expiresAt: time.Now().Add(time.Hour),
+			use:       func(c Client) (uuid.UUID, error) { return c.UseOIDCLoginToken("hash") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			userID := createTestUser(t, c, "boots@example.com")
+			err := c.CreateUserToken(CreateUserTokenParams{
+				UserID:    userID,
+				Purpose:   tt.purpose,
+				Email:     "boots@example.com",
+				Hash:      "hash",
+				ExpiresAt: tt.expiresAt,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tt.use(c)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != userID {
+				t.Errorf("token was for %s, want %s", got, userID)
+			}
+			if _, err := tt.use(c); !errors.Is(err, ErrUserTokenInvalid) {
+				t.Errorf("using the token twice: error = %v, want ErrUserTokenInvalid", err)
+			}
+		})
+	}
+}
+
+func TestResetPasswordRevokesSessions(t *testing.T) {
+	c := newTestClient(t)
+	userID := createTestUser(t, c, "boots@example.com")
+	session, err := c.CreateSession(CreateSessionParams{UserID: userID, RefreshToken: "t1", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RecordLoginFailure(userID, 10, func(int) time.Duration { return time.Hour }); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{"first", "second"} {
+		err := c.CreateUserToken(CreateUserTokenParams{
+			UserID:    userID,
+			Purpose:   UserTokenResetPassword,
+			Email:     "boots@example.com",
+			Hash:      hash,
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.ResetPassword("first", "new-hash"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := c.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Password != "new-hash" || user.FailedLogins != 0 || user.LockedUntil != nil {
+		t.Errorf("user after reset = password %q, %d failed logins, locked until %v", user.Password, user.FailedLogins, user.LockedUntil)
+	}
+	if _, err := c.ResetPassword("second", "other-hash"); !errors.Is(err, ErrUserTokenInvalid) {
+		t.Errorf("using another reset token: error = %v, want ErrUserTokenInvalid", err)
+	}
+	if _, err := c.RotateRefreshToken("t1", "t2", time.Now().Add(time.Hour), SessionClient{}); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("refreshing after a reset: error = %v, want ErrRefreshTokenInvalid", err)
+	}
+	got, err := c.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RevokedAt == nil {
+		t.Error("session wasn't revoked by the reset")
+	}
+}
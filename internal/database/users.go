@@ -8,24 +8,84 @@ import (
 	"github.com/google/uuid"
 )
 
+// Role is what a user is allowed to do beyond managing their own videos.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast reports whether r includes everything role may do.
+func (r Role) AtLeast(role Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[role]
+}
+
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              uuid.UUID  `json:"id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	Role            Role       `json:"role"`
+	DisabledAt      *time.Time `json:"disabled_at"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at"`
+	FailedLogins    int        `json:"failed_login_count"`
+	LockedUntil     *time.Time `json:"locked_until"`
+	// DeletedAt is set when the user asked for their account to be
+	// deleted. It stays disabled until the deletion finishes.
+	DeletedAt   *time.Time `json:"deleted_at"`
+	DisplayName string     `json:"display_name"`
+	Bio         string     `json:"bio"`
+	AvatarURL   *string    `json:"avatar_url"`
 	CreateUserParams
 }
 
 type CreateUserParams struct {
 	Email    string `json:"email"`
-	Password string `json:"password"`
+	Password string `json:"-"`
+}
+
+const userColumns = `id, created_at, updated_at, email, password, role, disabled_at, email_verified_at, totp_enabled_at, failed_login_count, locked_until, deleted_at, display_name, bio, avatar_url`
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Email,
+		&user.Password,
+		&user.Role,
+		&user.DisabledAt,
+		&user.EmailVerifiedAt,
+		&user.TOTPEnabledAt,
+		&user.FailedLogins,
+		&user.LockedUntil,
+		&user.DeletedAt,
+		&user.DisplayName,
+		&user.Bio,
+		&user.AvatarURL,
+	)
+	return user, err
 }
 
 func (c Client) GetUsers() ([]User, error) {
 	query := `
-		SELECT
-			id,
-			email
+		SELECT ` + userColumns + `
 		FROM users
+		ORDER BY created_at, id
 	`
 
 	rows, err := c.db.Query(query)
@@ -36,68 +96,34 @@ func (c Client) GetUsers() ([]User, error) {
 
 	users := []User{}
 	for rows.Next() {
-		var user User
-		var id string
-		if err := rows.Scan(&id, &user.Email); err != nil {
-			return nil, err
-		}
-		user.ID, err = uuid.Parse(id)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
 		users = append(users, user)
 	}
 
-	return users, nil
+	return users, rows.Err()
 }
 
 func (c Client) GetUserByEmail(email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT ` + userColumns + `
 		FROM users
-		WHERE email = ?
+		WHERE email = ? COLLATE NOCASE
+		ORDER BY created_at
+		LIMIT 1
 	`
-	var user User
-	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRow(query, email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
 		}
 		return User{}, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return User{}, err
-	}
 	return user, nil
 }
 
-func (c Client) GetUserByRefreshToken(token string) (*User, error) {
-	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
-		FROM users u
-		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
-	`
-
-	var user User
-	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
 func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 	id := uuid.New()
 
@@ -117,31 +143,120 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE id = ?
 	`
-	var user User
-	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRow(query, id.String()))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(idStr)
+	return &user, nil
+}
+
+func (c Client) SetUserRole(id uuid.UUID, role Role) error {
+	query := `
+		UPDATE users
+		SET role = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, role, id)
+	return err
+}
+
+// DisableUser stops a user from logging in or using the API. Their
+// sessions and API keys are revoked, so re-enabling them doesn't bring
+// those back.
+func (c Client) DisableUser(id uuid.UUID) error {
+	tx, err := c.db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &user, nil
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET disabled_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND disabled_at IS NULL
+	`, id)
+	if err != nil {
+		return err
+	}
+	if err := revokeSessions(tx, "user_id = ?", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE api_keys
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+	`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+// EnableUser lets a disabled user log in again. Users being deleted stay
+// disabled.
+func (c Client) EnableUser(id uuid.UUID) error {
 	query := `
-		DELETE FROM users
+		UPDATE users
+		SET disabled_at = NULL, failed_login_count = 0, locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+// RecordLoginFailure counts a failed login against a user and locks them
+// out for as long as lockout says for their new number of failures. Once a
+// lockout that followed restartAfter or more failures has expired, the
+// count starts again from one.
+func (c Client) RecordLoginFailure(id uuid.UUID, restartAfter int, lockout func(failures int) time.Duration) (User, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET failed_login_count = CASE
+			WHEN failed_login_count >= ? AND locked_until <= ? THEN 1
+			ELSE failed_login_count + 1
+		END
 		WHERE id = ?
+	`, restartAfter, time.Now().UTC().Format(sqliteTimestampFormat), id)
+	if err != nil {
+		return User{}, err
+	}
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		return User{}, err
+	}
+	if d := lockout(user.FailedLogins); d > 0 {
+		// Timestamps are stored to the second, so round up rather than
+		// unlock early.
+		lockedUntil := time.Now().UTC().Add(d).Truncate(time.Second).Add(time.Second)
+		_, err = tx.Exec(`UPDATE users SET locked_until = ? WHERE id = ?`, lockedUntil.Format(sqliteTimestampFormat), id)
+		if err != nil {
+			return User{}, err
+		}
+		user.LockedUntil = &lockedUntil
+	}
+	return user, tx.Commit()
+}
+
+// ResetLoginFailures clears a user's failed logins and any lockout.
+func (c Client) ResetLoginFailures(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET failed_login_count = 0, locked_until = NULL
+		WHERE id = ? AND (failed_login_count > 0 OR locked_until IS NOT NULL)
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.Exec(query, id)
 	return err
 }
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordLoginFailure(t *testing.T) {
+	c := newTestClient(t)
+	id := createTestUser(t, c, "boots@example.com")
+	lockout := func(failures int) time.Duration {
+		if failures < 3 {
+			return 0
+		}
+		return time.Hour
+	}
+
+	tests := []struct {
+		name string
+		// setup runs before the failure is recorded.
+		setup      string
+		wantCount  int
+		wantLocked bool
+	}{
+		{name: "first failure", wantCount: 1},
+		{name: "second failure", wantCount: 2},
+		{name: "locks out", wantCount: 3, wantLocked: true},
+		{name: "counts while locked", wantCount: 4, wantLocked: true},
+		{
+			name:      "restarts after the lockout",
+			setup:     `UPDATE users SET locked_until = datetime('now', '-1 minute')`,
+			wantCount: 1,
+		},
+		{name: "counts again", wantCount: 2},
+		{
+			name:      "expired lockout below the threshold",
+			setup:     `UPDATE users SET failed_login_count = 2, locked_until = datetime('now', '-1 minute')`,
+			wantCount: 3, wantLocked: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != "" {
+				if _, err := c.db.Exec(tt.setup); err != nil {
+					t.Fatal(err)
+				}
+			}
+			user, err := c.RecordLoginFailure(id, 3, lockout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.FailedLogins != tt.wantCount {
+				t.Errorf("failed logins = %d, want %d", user.FailedLogins, tt.wantCount)
+			}
+			locked := user.LockedUntil != nil && time.Now().Before(*user.LockedUntil)
+			if locked != tt.wantLocked {
+				t.Errorf("locked until %v, want locked = %v", user.LockedUntil, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestRecordLoginFailureLockedUntil(t *testing.T) {
+	c := newTestClient(t)
+	id := createTestUser(t, c, "boots@example.com")
+
+	before := time.Now()
+	user, err := c.RecordLoginFailure(id, 10, func(int) time.Duration { return 2 * time.Second })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lockouts are stored to the second, rounded up so they're never
+	// shorter than asked for.
+	if user.LockedUntil == nil || user.LockedUntil.Before(before.Add(2*time.Second)) || user.LockedUntil.After(before.Add(4*time.Second)) {
+		t.Fatalf("locked until %v, want 2-3s after %v", user.LockedUntil, before)
+	}
+	stored, err := c.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LockedUntil == nil || !stored.LockedUntil.Equal(*user.LockedUntil) {
+		t.Errorf("stored lockout %v, returned %v", stored.LockedUntil, user.LockedUntil)
+	}
+}
@@ -3,29 +3,68 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrVideoVersionConflict is returned when a video row was changed by
+// someone else between the time it was read and the time it was written.
+var ErrVideoVersionConflict = errors.New("video was modified concurrently")
+
+// ErrVideoNotTrashed is returned when purging a video that is no longer in
+// the trash, or wasn't there before the cutoff, because it was restored or
+// is already gone.
+var ErrVideoNotTrashed = errors.New("video is not in the trash")
+
+// ErrVideoNotFound is returned when changing a video that doesn't exist or
+// is in the trash.
+var ErrVideoNotFound = errors.New("video not found")
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	ThumbnailURL *string    `json:"thumbnail_url"`
+	VideoURL     *string    `json:"video_url"`
+	Version      int        `json:"version"`
+	Duration     float64    `json:"duration"`
+	DeletedAt    *time.Time `json:"deleted_at"`
+	// ThumbnailSHA256 and VideoSHA256 are hex checksums of the stored
+	// objects, kept for audits.
+	ThumbnailSHA256 *string `json:"thumbnail_sha256"`
+	VideoSHA256     *string `json:"video_sha256"`
 	CreateVideoParams
 }
 
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Visibility  Visibility `json:"visibility"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// Visibility controls who can see a video. Private videos are only visible
+// to their owner, unlisted ones to anyone who has the ID, and public ones
+// are also listed for everyone.
+type Visibility string
+
+const (
+	VisibilityPrivate  Visibility = "private"
+	VisibilityUnlisted Visibility = "unlisted"
+	VisibilityPublic   Visibility = "public"
+)
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,37 +72,153 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		version,
+		duration,
+		deleted_at,
+		visibility,
+		thumbnail_sha256,
+		video_sha256`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// videoFields returns scan destinations matching videoColumns.
+func videoFields(video *Video) []any {
+	return []any{
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.Version,
+		&video.Duration,
+		&video.DeletedAt,
+		&video.Visibility,
+		&video.ThumbnailSHA256,
+		&video.VideoSHA256,
+	}
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(videoFields(&video)...)
+	return video, err
+}
+
+type GetVideosParams struct {
+	// UserID limits the listing to one user's videos. It may be left
+	// unset when listing by Visibility.
+	UserID     uuid.UUID
+	Visibility Visibility
+	Sort       VideoSort
+	Limit      int
+	Cursor     string
+	// Deleted lists videos in the trash instead of live ones.
+	Deleted bool
+}
+
+type VideoPage struct {
+	Videos     []Video `json:"videos"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// GetVideos returns one page of a user's videos using keyset pagination:
+// the cursor holds the sort value and ID of the last video returned, and
+// the next page starts strictly after it.
+func (c Client) GetVideos(params GetVideosParams) (VideoPage, error) {
+	if params.UserID == uuid.Nil && params.Visibility == "" {
+		return VideoPage{}, errors.New("listing videos requires a user or a visibility")
+	}
+	if params.Sort == "" {
+		params.Sort = VideoSortCreatedAt
+	}
+	if !params.Sort.Valid() {
+		return VideoPage{}, fmt.Errorf("invalid sort %q", params.Sort)
+	}
+	if params.Limit <= 0 {
+		params.Limit = DefaultVideoPageLimit
+	}
+	if params.Limit > MaxVideoPageLimit {
+		params.Limit = MaxVideoPageLimit
+	}
+
+	column := string(params.Sort)
+	cmp, direction := ">", "ASC"
+	if params.Sort.descending() {
+		cmp, direction = "<", "DESC"
+	}
+
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
 	`
+	if params.Deleted {
+		query += "WHERE deleted_at IS NOT NULL\n"
+	} else {
+		query += "WHERE deleted_at IS NULL\n"
+	}
+	args := []any{}
+	if params.UserID != uuid.Nil {
+		query += "AND user_id = ?\n"
+		args = append(args, params.UserID)
+	}
+	if params.Visibility != "" {
+		query += "AND visibility = ?\n"
+		args = append(args, params.Visibility)
+	}
+	if params.Cursor != "" {
+		cursor, err := decodeVideoCursor(params.Sort, params.Cursor)
+		if err != nil {
+			return VideoPage{}, err
+		}
+		query += fmt.Sprintf("AND (%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))\n", column, cmp)
+		args = append(args, cursor.Value, cursor.Value, cursor.ID)
+	}
+	query += fmt.Sprintf("ORDER BY %[1]s %[2]s, id %[2]s\nLIMIT ?", column, direction)
+	// Fetch one extra row to learn whether another page exists.
+	args = append(args, params.Limit+1)
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return VideoPage{}, err
 	}
 	defer rows.Close()
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
-			return nil, err
+		video, err := scanVideo(rows)
+		if err != nil {
+			return VideoPage{}, err
 		}
 		videos = append(videos, video)
 	}
+	if err := rows.Err(); err != nil {
+		return VideoPage{}, err
+	}
 
-	return videos, nil
+	page := VideoPage{Videos: videos}
+	if len(videos) > params.Limit {
+		page.Videos = videos[:params.Limit]
+		next, err := encodeVideoCursor(params.Sort, page.Videos[params.Limit-1])
+		if err != nil {
+			return VideoPage{}, err
+		}
+		page.NextCursor = &next
+	}
+	return page, nil
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -75,42 +230,49 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPrivate
+	}
+
+	tx, err := c.db.Begin()
 	if err != nil {
 		return Video{}, err
 	}
+	defer tx.Rollback()
+
+	if err := ensureUsage(tx, params.UserID); err != nil {
+		return Video{}, err
+	}
+	_, err = tx.Exec(query, id, params.Title, params.Description, params.UserID, params.Visibility)
+	if err != nil {
+		return Video{}, err
+	}
+	if err := addUsage(tx, params.UserID, usageDelta{videos: 1}); err != nil {
+		return Video{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Video{}, err
+	}
 
 	return c.GetVideo(id)
 }
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+	return getVideo(c.db, id)
+}
+
+func getVideo(db queryExecer, id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,7 +283,17 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// UpdateVideo writes the video back only if its version still matches the
+// one that was read, and returns the row as stored.
+func (c Client) UpdateVideo(video Video) (Video, error) {
+	err := updateVideo(c.db, video)
+	if err != nil {
+		return Video{}, err
+	}
+	return c.GetVideo(video.ID)
+}
+
+func updateVideo(db execer, video Video) error {
 	query := `
 	UPDATE videos
 	SET
@@ -129,27 +301,226 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
-	WHERE id = ?
+		user_id = ?,
+		duration = ?,
+		visibility = ?,
+		thumbnail_sha256 = ?,
+		video_sha256 = ?,
+		version = version + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND version = ?
 	`
 
-	_, err := c.db.Exec(
+	result, err := db.Exec(
 		query,
 		video.Title,
 		video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
+		video.ThumbnailURL,
+		video.VideoURL,
 		video.UserID,
+		video.Duration,
+		video.Visibility,
+		video.ThumbnailSHA256,
+		video.VideoSHA256,
 		video.ID,
+		video.Version,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrVideoVersionConflict
+	}
+	return nil
+}
+
+// TrashVideo soft deletes a video. It stays restorable until the purger
+// removes it for good.
+func (c Client) TrashVideo(id uuid.UUID) error {
+	return c.setVideoDeletedAt(id, "CURRENT_TIMESTAMP", "deleted_at IS NULL")
+}
+
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	return c.setVideoDeletedAt(id, "NULL", "deleted_at IS NOT NULL")
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+func (c Client) setVideoDeletedAt(id uuid.UUID, value, condition string) error {
 	query := `
-	DELETE FROM videos
+	UPDATE videos
+	SET
+		deleted_at = ` + value + `,
+		version = version + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND ` + condition
+	result, err := c.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrVideoVersionConflict
+	}
+	return nil
+}
+
+// TransferVideo gives a video to another user, moving its storage and
+// count from the old owner's usage to the new one's. Quotas aren't
+// checked. Videos in the trash can't be transferred, since purging them
+// takes them off the owner's usage; it returns ErrVideoNotFound for them.
+func (c Client) TransferVideo(id, toUserID uuid.UUID) (Video, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Video{}, err
+	}
+	defer tx.Rollback()
+
+	var fromUserID uuid.UUID
+	err = tx.QueryRow(`SELECT user_id FROM videos WHERE id = ? AND deleted_at IS NULL`, id).Scan(&fromUserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Video{}, ErrVideoNotFound
+	}
+	if err != nil {
+		return Video{}, err
+	}
+	if fromUserID == toUserID {
+		return c.GetVideo(id)
+	}
+	for _, userID := range []uuid.UUID{fromUserID, toUserID} {
+		if err := ensureUsage(tx, userID); err != nil {
+			return Video{}, err
+		}
+	}
+	bytes, err := committedBytes(tx, "u.video_id = ?", id)
+	if err != nil {
+		return Video{}, err
+	}
+
+	_, err = tx.Exec(`
+	UPDATE videos
+	SET user_id = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
+	`, toUserID, id)
+	if err != nil {
+		return Video{}, err
+	}
+	if err := addUsage(tx, fromUserID, usageDelta{bytes: -bytes, videos: -1}); err != nil {
+		return Video{}, err
+	}
+	if err := addUsage(tx, toUserID, usageDelta{bytes: bytes, videos: 1}); err != nil {
+		return Video{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Video{}, err
+	}
+	return c.GetVideo(id)
+}
+
+// GetTrashedVideos returns videos that were moved to the trash before the
+// given time.
+func (c Client) GetTrashedVideos(deletedBefore time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at < ?
+	ORDER BY deleted_at
 	`
-	_, err := c.db.Exec(query, id)
-	return err
+	rows, err := c.db.Query(query, deletedBefore.UTC().Format(sqliteTimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// DeleteVideo permanently removes a video row along with its upload
+// records and takes it off the owner's video count. The video must still
+// be in the trash, moved there before deletedBefore. Callers are
+// responsible for releasing its assets first.
+func (c Client) DeleteVideo(id uuid.UUID, deletedBefore time.Time) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := trashedVideoOwner(tx, id, deletedBefore)
+	if err != nil {
+		return err
+	}
+	if err := ensureUsage(tx, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM uploads WHERE video_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM videos WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := addUsage(tx, userID, usageDelta{videos: -1}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// trashedVideoOwner returns the owner of a video that was moved to the
+// trash before deletedBefore, or ErrVideoNotTrashed.
+func trashedVideoOwner(tx *sql.Tx, id uuid.UUID, deletedBefore time.Time) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := tx.QueryRow(`
+	SELECT user_id FROM videos
+	WHERE id = ? AND deleted_at IS NOT NULL AND deleted_at < ?
+	`, id, deletedBefore.UTC().Format(sqliteTimestampFormat)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, ErrVideoNotTrashed
+	}
+	return userID, err
+}
+
+// ObjectReference is what a video row points at in storage.
+type ObjectReference struct {
+	VideoID      uuid.UUID
+	ThumbnailURL *string
+	VideoURL     *string
+}
+
+// getObjectReferences returns the stored object URLs of every video,
+// including those in the trash.
+func getObjectReferences(q querier) ([]ObjectReference, error) {
+	query := `
+	SELECT id, thumbnail_url, video_url
+	FROM videos
+	WHERE thumbnail_url IS NOT NULL OR video_url IS NOT NULL
+	`
+	rows, err := q.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []ObjectReference{}
+	for rows.Next() {
+		var ref ObjectReference
+		if err := rows.Scan(&ref.VideoID, &ref.ThumbnailURL, &ref.VideoURL); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
 }
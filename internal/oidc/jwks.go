@@ -0,0 +1,184 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// supportedAlgorithms are the ID token signing algorithms accepted.
+// Symmetric algorithms aren't, since they'd use the client secret as the
+// key.
+var supportedAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// minRefetchInterval stops tokens with unknown key IDs from making us
+// fetch the provider's keys on every request.
+const minRefetchInterval = time.Minute
+
+// keySet is a provider's signing keys, fetched from its JWKS endpoint and
+// refetched when a token names a key it doesn't have, which is how
+// providers rotate keys.
+type keySet struct {
+	uri      string
+	provider *Provider
+
+	mu        sync.Mutex
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+func newKeySet(uri string, provider *Provider) *keySet {
+	return &keySet{uri: uri, provider: provider}
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// key returns the public key a token was signed with.
+func (ks *keySet) key(ctx context.Context, token *jwt.Token) (any, error) {
+	id, _ := token.Header["kid"].(string)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.lookup(id)
+	if !ok && time.Since(ks.fetchedAt) >= minRefetchInterval {
+		if err := ks.fetch(ctx); err != nil {
+			return nil, err
+		}
+		k, ok = ks.lookup(id)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", id)
+	}
+
+	switch k.(type) {
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	case ed25519.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodEd25519)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), id)
+	}
+	return k, nil
+}
+
+// lookup finds a key by ID. Tokens without a key ID can only be verified
+// if the provider has a single key.
+func (ks *keySet) lookup(id string) (any, bool) {
+	if id == "" {
+		if len(ks.keys) != 1 {
+			return nil, false
+		}
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	k, ok := ks.keys[id]
+	return k, ok
+}
+
+func (ks *keySet) fetch(ctx context.Context) error {
+	ks.fetchedAt = time.Now()
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := ks.provider.getJSON(ctx, ks.uri, &set)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch provider keys: %w", err)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.publicKey()
+		if err != nil {
+			// Skip keys of types we don't use rather than failing.
+			continue
+		}
+		keys[jwk.KeyID] = k
+	}
+	ks.keys = keys
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		k := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(k.X, k.Y) {
+			return nil, errors.New("EC point isn't on the curve")
+		}
+		return k, nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Ed25519 key has the wrong size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+}
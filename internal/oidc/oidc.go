@@ -0,0 +1,272 @@
+// Package oidc implements the relying party side of OpenID Connect's
+// authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// discoveryTTL is how long the provider's configuration is cached for.
+const discoveryTTL = time.Hour
+
+// Provider is an OpenID Connect identity provider. Its configuration is
+// discovered on first use, so the provider doesn't have to be up when the
+// server starts.
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	client       *http.Client
+
+	mu           sync.Mutex
+	config       providerConfig
+	discoveredAt time.Time
+	keys         *keySet
+}
+
+// providerConfig is the part of the discovery document (OpenID Connect
+// Discovery 1.0) the flow needs.
+type providerConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider returns a provider for issuer. clientSecret may be empty for
+// public clients, which rely on PKCE alone.
+func NewProvider(issuer, clientID, clientSecret, redirectURL string) *Provider {
+	return &Provider{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+func (p *Provider) discover(ctx context.Context) (providerConfig, *keySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil && time.Since(p.discoveredAt) < discoveryTTL {
+		return p.config, p.keys, nil
+	}
+
+	var config providerConfig
+	err := p.getJSON(ctx, strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", &config)
+	if err != nil {
+		return providerConfig{}, nil, fmt.Errorf("couldn't discover provider: %w", err)
+	}
+	if config.Issuer != p.issuer {
+		return providerConfig{}, nil, fmt.Errorf("provider says its issuer is %q, not %q", config.Issuer, p.issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return providerConfig{}, nil, errors.New("provider configuration is missing endpoints")
+	}
+
+	p.config = config
+	p.discoveredAt = time.Now()
+	if p.keys == nil || p.keys.uri != config.JWKSURI {
+		p.keys = newKeySet(config.JWKSURI, p)
+	}
+	return p.config, p.keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// AuthRequest is what a login has to remember between sending the user to
+// the provider and the provider sending them back.
+type AuthRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// NewAuthRequest returns random values for a new login.
+func NewAuthRequest() (AuthRequest, error) {
+	var values [3]string
+	for i := range values {
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			return AuthRequest{}, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return AuthRequest{
+		State:        values[0],
+		Nonce:        values[1],
+		CodeVerifier: values[2],
+	}, nil
+}
+
+// codeChallenge is the S256 PKCE challenge for the request's verifier.
+func (ar AuthRequest) codeChallenge() string {
+	sum := sha256.Sum256([]byte(ar.CodeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the provider URL to send the user to for ar.
+func (p *Provider) AuthCodeURL(ctx context.Context, ar AuthRequest) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(config.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientID)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", "openid email")
+	query.Set("state", ar.State)
+	query.Set("nonce", ar.Nonce)
+	query.Set("code_challenge", ar.codeChallenge())
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Claims is what the provider says about the user who logged in.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp"`
+	Email           string `json:"email"`
+	// Some providers send email_verified as a string.
+	EmailVerified any `json:"email_verified"`
+}
+
+// Exchange redeems an authorization code for the ID token of the user who
+// logged in, and verifies it.
+func (p *Provider) Exchange(ctx context.Context, code string, ar AuthRequest) (Claims, error) {
+	config, keys, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {ar.CodeVerifier},
+	}
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Claims{}, err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token)
+	if err != nil {
+		return Claims{}, fmt.Errorf("couldn't decode token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Claims{}, fmt.Errorf("token request failed: %s %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return Claims{}, errors.New("token response has no ID token")
+	}
+	return p.verify(ctx, keys, token.IDToken, ar.Nonce)
+}
+
+// verify checks an ID token's signature and that it was issued by the
+// provider to this client for this login (OpenID Connect Core 3.1.3.7).
+func (p *Provider) verify(ctx context.Context, keys *keySet, idToken, nonce string) (Claims, error) {
+	claims := idTokenClaims{}
+	_, err := jwt.ParseWithClaims(
+		idToken,
+		&claims,
+		func(token *jwt.Token) (any, error) {
+			return keys.key(ctx, token)
+		},
+		jwt.WithValidMethods(supportedAlgorithms),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientID),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return Claims{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return Claims{}, errors.New("invalid ID token: no expiry")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.clientID {
+		return Claims{}, errors.New("invalid ID token: issued to another party")
+	}
+	if claims.Nonce != nonce {
+		return Claims{}, errors.New("invalid ID token: nonce doesn't match")
+	}
+	if claims.Subject == "" {
+		return Claims{}, errors.New("invalid ID token: no subject")
+	}
+
+	verified, _ := claims.EmailVerified.(bool)
+	if s, ok := claims.EmailVerified.(string); ok {
+		verified = s == "true"
+	}
+	return Claims{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified,
+	}, nil
+}
@@ -0,0 +1,312 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID    = "tubely"
+	testRedirectURL = "http://localhost:8091/api/oidc/callback"
+)
+
+// login runs a login at the mock provider and exchanges the code it
+// redirects back with.
+func login(t *testing.T, idp *oidctest.Provider, p *Provider, user oidctest.Login) (Claims, error) {
+	t.Helper()
+	ctx := context.Background()
+	ar, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(ctx, ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := idp.Authorize(authURL, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.Get("state") != ar.State {
+		t.Fatalf("state = %q, want %q", callback.Get("state"), ar.State)
+	}
+	return p.Exchange(ctx, callback.Get("code"), ar)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := oidctest.NewProvider(t, testClientID)
+	p := NewProvider(idp.Issuer(), testClientID, "", testRedirectURL)
+
+	ar, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(context.Background(), ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != idp.Issuer()+"/authorize" {
+		t.Errorf("endpoint = %q, want the discovered authorization endpoint", got)
+	}
+
+	sum := sha256.Sum256([]byte(ar.CodeVerifier))
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"state":                 ar.State,
+		"nonce":                 ar.Nonce,
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(sum[:]),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if !strings.Contains(u.Query().Get("scope"), "openid") {
+		t.Errorf("scope %q doesn't include openid", u.Query().Get("scope"))
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := oidctest.NewProvider(t, testClientID)
+
+	tests := []struct {
+		name    string
+		issuer  string
+		wantErr string
+	}{
+		{name: "matching issuer", issuer: idp.Issuer()},
+		{name: "issuer mismatch", issuer: idp.Issuer() + "/", wantErr: "issuer"},
+		{name: "no provider", issuer: idp.Issuer() + "/missing", wantErr: "couldn't discover provider"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProvider(tt.issuer, testClientID, "", testRedirectURL)
+			_, err := p.AuthCodeURL(context.Background(), AuthRequest{})
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := oidctest.NewProvider(t, testClientID)
+	p := NewProvider(idp.Issuer(), testClientID, "", testRedirectURL)
+	other := oidctest.NewProvider(t, testClientID)
+
+	tests := []struct {
+		name string
+		user oidctest.Login
+		// idToken, if set, makes the provider return this token instead.
+		idToken func(t *testing.T) string
+		want    Claims
+		wantErr string
+	}{
+		{
+			name: "verified email",
+			user: oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+			want: Claims{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+		},
+		{
+			name: "email_verified as a string",
+			user: oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: "true"},
+			want: Claims{Subject: "sub-1", Email: "boots@example.com", EmailVerified: true},
+		},
+		{
+			name: "unverified email",
+			user: oidctest.Login{Subject: "sub-1", Email: "boots@example.com", EmailVerified: false},
+			want: Claims{Subject: "sub-1", Email: "boots@example.com"},
+		},
+		{
+			name: "no email_verified",
+			user: oidctest.Login{Subject: "sub-1", Email: "boots@example.com"},
+			want: Claims{Subject: "sub-1", Email: "boots@example.com"},
+		},
+		{
+			name:    "nonce mismatch",
+			user:    oidctest.Login{Subject: "sub-1", Claims: jwt.MapClaims{"nonce": "replayed"}},
+			wantErr: "nonce",
+		},
+		{
+			name:    "no nonce",
+			user:    oidctest.Login{Subject: "sub-1", Claims: jwt.MapClaims{"nonce": nil}},
+			wantErr: "nonce",
+		},
+		{
+			name:    "issued to another client",
+			user:    oidctest.Login{Subject: "sub-1", Claims: jwt.MapClaims{"aud": "someone-else"}},
+			wantErr: "audience",
+		},
+		{
+			name: "another authorized party",
+			user: oidctest.Login{Subject: "sub-1", Claims: jwt.MapClaims{
+				"aud": []string{testClientID, "someone-else"},
+				"azp": "someone-else",
+			}},
+			wantErr: "another party",
+		},
+		{
+			name:    "another issuer",
+			user:    oidctest.Login{Subject: "sub-1", Claims: jwt.MapClaims{"iss": "https://evil.example.com"}},
+			wantErr: "issuer",
+		},
+		{
+			name:    "expired",
+			user:    oidctest.Login{Subject: "sub-1", Claims: jwt.MapClaims{"exp": time.Now().Add(-2 * time.Minute).Unix()}},
+			wantErr: "expired",
+		},
+		{
+			name:    "no expiry",
+			user:    oidctest.Login{Subject: "sub-1", Claims: jwt.MapClaims{"exp": nil}},
+			wantErr: "no expiry",
+		},
+		{
+			name:    "no subject",
+			user:    oidctest.Login{Claims: jwt.MapClaims{"sub": nil}},
+			wantErr: "no subject",
+		},
+		{
+			name: "signed by another provider's key",
+			idToken: func(t *testing.T) string {
+				return sign(t, other, jwt.MapClaims{
+					"iss": idp.Issuer(),
+					"aud": testClientID,
+					"sub": "sub-1",
+					"exp": time.Now().Add(time.Minute).Unix(),
+				})
+			},
+			wantErr: "unknown key ID",
+		},
+		{
+			name: "signed with HMAC",
+			idToken: func(t *testing.T) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+					"iss": idp.Issuer(),
+					"aud": testClientID,
+					"sub": "sub-1",
+					"exp": time.Now().Add(time.Minute).Unix(),
+				})
+				s, err := token.SignedString([]byte("client-secret"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			},
+			wantErr: "signing method",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			if tt.idToken != nil {
+				user.IDToken = tt.idToken(t)
+			}
+			got, err := login(t, idp, p, user)
+			checkErr(t, err, tt.wantErr)
+			if err == nil && got != tt.want {
+				t.Errorf("claims = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeChecksPKCE(t *testing.T) {
+	idp := oidctest.NewProvider(t, testClientID)
+	p := NewProvider(idp.Issuer(), testClientID, "", testRedirectURL)
+	ctx := context.Background()
+
+	ar, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(ctx, ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := idp.Authorize(authURL, oidctest.Login{Subject: "sub-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stolen := ar
+	stolen.CodeVerifier = "not-the-verifier"
+	_, err = p.Exchange(ctx, callback.Get("code"), stolen)
+	checkErr(t, err, "invalid_grant")
+}
+
+func TestClientAuthentication(t *testing.T) {
+	idp := oidctest.NewProvider(t, testClientID)
+	idp.ClientSecret = "s3cret"
+
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr string
+	}{
+		{name: "right secret", secret: "s3cret"},
+		{name: "wrong secret", secret: "guess", wantErr: "invalid_client"},
+		{name: "public client", secret: "", wantErr: "invalid_client"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProvider(idp.Issuer(), testClientID, tt.secret, testRedirectURL)
+			_, err := login(t, idp, p, oidctest.Login{Subject: "sub-1"})
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := oidctest.NewProvider(t, testClientID)
+	p := NewProvider(idp.Issuer(), testClientID, "", testRedirectURL)
+	user := oidctest.Login{Subject: "sub-1"}
+
+	if _, err := login(t, idp, p, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys were fetched moments ago, so a new key ID isn't fetched yet.
+	idp.RotateKey(t)
+	_, err := login(t, idp, p, user)
+	checkErr(t, err, "unknown key ID")
+
+	p.keys.fetchedAt = time.Now().Add(-minRefetchInterval)
+	if _, err := login(t, idp, p, user); err != nil {
+		t.Fatalf("after the refetch interval: %v", err)
+	}
+}
+
+func sign(t *testing.T, idp *oidctest.Provider, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := idp.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("error = %v, want one containing %q", err, want)
+	}
+}
@@ -0,0 +1,243 @@
+// Package oidctest runs a mock OpenID Connect provider for tests. It
+// serves discovery, JWKS and token endpoints over httptest, and logs users
+// in without a login page: Authorize takes the URL the relying party would
+// send the browser to and returns what the provider would redirect back
+// with.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Provider is a running mock provider. Its issuer is the server's URL.
+type Provider struct {
+	Server   *httptest.Server
+	ClientID string
+	// ClientSecret is required at the token endpoint if it's set.
+	ClientSecret string
+
+	mu     sync.Mutex
+	key    *rsa.PrivateKey
+	keyID  string
+	grants map[string]grant
+}
+
+// Login is the user who logs in at the provider.
+type Login struct {
+	Subject       string
+	Email         string
+	EmailVerified any
+	// Claims are added to the ID token, replacing the defaults. A nil
+	// value removes the claim.
+	Claims jwt.MapClaims
+	// IDToken, if set, is returned by the token endpoint as is.
+	IDToken string
+}
+
+type grant struct {
+	login         Login
+	nonce         string
+	codeChallenge string
+	redirectURI   string
+}
+
+// NewProvider starts a provider for the client clientID, which is shut
+// down when the test ends.
+func NewProvider(t testing.TB, clientID string) *Provider {
+	t.Helper()
+	p := &Provider{
+		ClientID: clientID,
+		grants:   map[string]grant{},
+	}
+	p.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("GET /jwks", p.handleJWKS)
+	mux.HandleFunc("POST /token", p.handleToken)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Server.Close)
+	return p
+}
+
+// Issuer is the provider's issuer identifier.
+func (p *Provider) Issuer() string {
+	return p.Server.URL
+}
+
+// RotateKey replaces the provider's signing key with a new one under a new
+// key ID.
+func (p *Provider) RotateKey(t testing.TB) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.key = key
+	p.keyID = fmt.Sprintf("key-%d", time.Now().UnixNano())
+}
+
+// Sign signs claims with the provider's current key.
+func (p *Provider) Sign(claims jwt.Claims) (string, error) {
+	p.mu.Lock()
+	key, keyID := p.key, p.keyID
+	p.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(key)
+}
+
+// Authorize logs login in for the authorization request in authURL, as if
+// the user had approved it, and returns the query the provider redirects
+// back to the client with.
+func (p *Provider) Authorize(authURL string, login Login) (url.Values, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	switch {
+	case query.Get("response_type") != "code":
+		return nil, fmt.Errorf("unexpected response_type %q", query.Get("response_type"))
+	case query.Get("client_id") != p.ClientID:
+		return nil, fmt.Errorf("unexpected client_id %q", query.Get("client_id"))
+	case query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		return nil, fmt.Errorf("no S256 code challenge")
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.grants[code] = grant{
+		login:         login,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		redirectURI:   query.Get("redirect_uri"),
+	}
+	p.mu.Unlock()
+	return url.Values{"code": {code}, "state": {query.Get("state")}}, nil
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.Issuer(),
+		"authorization_endpoint": p.Issuer() + "/authorize",
+		"token_endpoint":         p.Issuer() + "/token",
+		"jwks_uri":               p.Issuer() + "/jwks",
+	})
+}
+
+func (p *Provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	pub, keyID := p.key.PublicKey, p.keyID
+	p.mu.Unlock()
+
+	encode := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(pub.N.Bytes()),
+			"e":   encode(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != p.ClientID || secret != p.ClientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, ok := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != g.codeChallenge ||
+		r.PostForm.Get("redirect_uri") != g.redirectURI {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	idToken := g.login.IDToken
+	if idToken == "" {
+		now := time.Now()
+		claims := jwt.MapClaims{
+			"iss":            p.Issuer(),
+			"aud":            p.ClientID,
+			"sub":            g.login.Subject,
+			"email":          g.login.Email,
+			"email_verified": g.login.EmailVerified,
+			"nonce":          g.nonce,
+			"iat":            now.Unix(),
+			"exp":            now.Add(5 * time.Minute).Unix(),
+		}
+		for name, value := range g.login.Claims {
+			if value == nil {
+				delete(claims, name)
+				continue
+			}
+			claims[name] = value
+		}
+		var err error
+		idToken, err = p.Sign(claims)
+		if err != nil {
+			tokenError(w, http.StatusInternalServerError, "server_error")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func tokenError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// advance moves the store's clock forward by d, by moving everything it
+// remembers back.
+func advance(s *MemoryStore, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.buckets {
+		b.updated = b.updated.Add(-d)
+		b.full = b.full.Add(-d)
+	}
+	s.lastSweep = s.lastSweep.Add(-d)
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	limit := Limit{Burst: 3, Period: 3 * time.Second}
+
+	type take struct {
+		// after is how long after the previous take this one happens.
+		after         time.Duration
+		wantAllowed   bool
+		wantRemaining int
+	}
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{
+			name: "burst then limited",
+			takes: []take{
+				{wantAllowed: true, wantRemaining: 2},
+				{wantAllowed: true, wantRemaining: 1},
+				{wantAllowed: true, wantRemaining: 0},
+				{wantAllowed: false, wantRemaining: 0},
+			},
+		},
+		{
+			name: "refills one token per interval",
+			takes: []take{
+				{wantAllowed: true, wantRemaining: 2},
+				{wantAllowed: true, wantRemaining: 1},
+				{wantAllowed: true, wantRemaining: 0},
+				{after: 500 * time.Millisecond, wantAllowed: false},
+				{after: 600 * time.Millisecond, wantAllowed: true, wantRemaining: 0},
+				{wantAllowed: false},
+			},
+		},
+		{
+			name: "refills no further than the burst",
+			takes: []take{
+				{wantAllowed: true, wantRemaining: 2},
+				{after: time.Hour, wantAllowed: true, wantRemaining: 2},
+			},
+		},
+		{
+			name: "denied requests don't use tokens",
+			takes: []take{
+				{wantAllowed: true, wantRemaining: 2},
+				{wantAllowed: true, wantRemaining: 1},
+				{wantAllowed: true, wantRemaining: 0},
+				{wantAllowed: false},
+				{wantAllowed: false},
+				{after: 1100 * time.Millisecond, wantAllowed: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			for i, step := range tt.takes {
+				advance(s, step.after)
+				got, err := s.Take(context.Background(), "key", limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Allowed != step.wantAllowed || got.Remaining != step.wantRemaining {
+					t.Fatalf("take %d = allowed %v, %d remaining, want %v, %d", i, got.Allowed, got.Remaining, step.wantAllowed, step.wantRemaining)
+				}
+				if got.Limit != limit.Burst {
+					t.Errorf("take %d limit = %d, want %d", i, got.Limit, limit.Burst)
+				}
+				if got.Allowed && got.RetryAfter != 0 {
+					t.Errorf("take %d was allowed with RetryAfter %s", i, got.RetryAfter)
+				}
+				if !got.Allowed && (got.RetryAfter <= 0 || got.RetryAfter > limit.interval()) {
+					t.Errorf("take %d RetryAfter = %s, want up to %s", i, got.RetryAfter, limit.interval())
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreReset(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Burst: 4, Period: 4 * time.Second}
+	for range 2 {
+		if _, err := s.Take(context.Background(), "key", limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.Take(context.Background(), "key", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three of four tokens are used, taking three intervals to refill.
+	if want := 3 * time.Second; got.Reset < want-10*time.Millisecond || got.Reset > want {
+		t.Errorf("Reset = %s, want about %s", got.Reset, want)
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Burst: 1, Period: time.Minute}
+	for _, key := range []string{"a", "b"} {
+		got, err := s.Take(context.Background(), key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Allowed {
+			t.Errorf("first take for %q wasn't allowed", key)
+		}
+	}
+	got, err := s.Take(context.Background(), "a", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Allowed {
+		t.Error("second take for \"a\" was allowed")
+	}
+}
+
+func TestMemoryStoreZeroLimit(t *testing.T) {
+	s := NewMemoryStore()
+	for _, limit := range []Limit{{}, {Burst: 5}, {Period: time.Second}, {Burst: -1, Period: time.Second}} {
+		for range 10 {
+			got, err := s.Take(context.Background(), "key", limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Allowed {
+				t.Fatalf("limit %+v denied a request", limit)
+			}
+		}
+	}
+	if len(s.buckets) != 0 {
+		t.Errorf("unlimited requests created %d buckets", len(s.buckets))
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Burst: 2, Period: 10 * time.Minute}
+	for _, key := range []string{"idle", "busy"} {
+		if _, err := s.Take(context.Background(), key, limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Refilling one token takes five minutes. Take the busy bucket's last
+	// token, then let the idle one refill completely.
+	advance(s, 4*time.Minute)
+	if _, err := s.Take(context.Background(), "busy", limit); err != nil {
+		t.Fatal(err)
+	}
+	advance(s, 2*time.Minute)
+	if _, err := s.Take(context.Background(), "other", limit); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.buckets["idle"]; ok {
+		t.Error("full bucket wasn't swept")
+	}
+	if _, ok := s.buckets["busy"]; !ok {
+		t.Error("bucket that isn't full yet was swept")
+	}
+}
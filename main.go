@@ -2,13 +2,22 @@ package main
 
 import (
 	"context"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -16,7 +25,7 @@ import (
 
 type apiConfig struct {
 	db               database.Client
-	jwtSecret        string
+	jwtKeys          *auth.KeySet
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
@@ -25,6 +34,22 @@ type apiConfig struct {
 	s3Client         *s3.Client
 	s3CfDistribution string
 	port             string
+	trashRetention   time.Duration
+	gcGracePeriod    time.Duration
+	gcDelete         bool
+	playbackTTLs     playbackTTLs
+	cfSigner         *sign.URLSigner
+	assetETags       *assetETagCache
+	defaultQuota     userQuota
+	rateLimiter      ratelimit.Store
+	trustedProxies   int
+	accessTokenTTL   time.Duration
+	refreshTokenTTL  time.Duration
+	mailer           mailer.Mailer
+	baseURL          string
+	oidc             *oidc.Provider
+	// userDeletions wakes runUserDeleter when a user asks to be deleted.
+	userDeletions chan struct{}
 }
 
 func main() {
@@ -39,10 +64,23 @@ func main() {
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
+	if !db.FullTextSearch() {
+		log.Println("SQLite was built without FTS5, video search will use LIKE matching. Build with -tags sqlite_fts5 to enable full-text search.")
+	}
 
 	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	jwtKeysDir := os.Getenv("JWT_KEYS_DIR")
+	var jwtKeys *auth.KeySet
+	if jwtKeysDir != "" {
+		jwtKeys, err = auth.LoadKeySet(jwtKeysDir, os.Getenv("JWT_SIGNING_KEY_ID"), jwtSecret)
+		if err != nil {
+			log.Fatalf("Couldn't load JWT keys: %v", err)
+		}
+	} else {
+		if jwtSecret == "" {
+			log.Fatal("JWT_SECRET environment variable is not set")
+		}
+		jwtKeys = auth.NewHMACKeySet(jwtSecret)
 	}
 
 	platform := os.Getenv("PLATFORM")
@@ -80,16 +118,171 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
+	trashRetention := 30 * 24 * time.Hour
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		trashRetention, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("TRASH_RETENTION must be a duration like 720h: %v", err)
+		}
+	}
+
+	gcGracePeriod := 24 * time.Hour
+	if value := os.Getenv("GC_GRACE_PERIOD"); value != "" {
+		gcGracePeriod, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("GC_GRACE_PERIOD must be a duration like 24h: %v", err)
+		}
+	}
+
+	accessTokenTTL := 15 * time.Minute
+	if value := os.Getenv("ACCESS_TOKEN_TTL"); value != "" {
+		accessTokenTTL, err = time.ParseDuration(value)
+		if err != nil || accessTokenTTL <= 0 {
+			log.Fatalf("ACCESS_TOKEN_TTL must be a positive duration like 15m: %v", err)
+		}
+	}
+
+	refreshTokenTTL := 60 * 24 * time.Hour
+	if value := os.Getenv("REFRESH_TOKEN_TTL"); value != "" {
+		refreshTokenTTL, err = time.ParseDuration(value)
+		if err != nil || refreshTokenTTL <= 0 {
+			log.Fatalf("REFRESH_TOKEN_TTL must be a positive duration like 1440h: %v", err)
+		}
+	}
+
+	var gcInterval time.Duration
+	if value := os.Getenv("GC_INTERVAL"); value != "" {
+		gcInterval, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("GC_INTERVAL must be a duration like 24h: %v", err)
+		}
+	}
+
+	ttls := playbackTTLs{
+		database.VisibilityPrivate:  15 * time.Minute,
+		database.VisibilityUnlisted: time.Hour,
+		database.VisibilityPublic:   6 * time.Hour,
+	}
+	for visibility, env := range map[database.Visibility]string{
+		database.VisibilityPrivate:  "PLAYBACK_URL_TTL_PRIVATE",
+		database.VisibilityUnlisted: "PLAYBACK_URL_TTL_UNLISTED",
+		database.VisibilityPublic:   "PLAYBACK_URL_TTL_PUBLIC",
+	} {
+		if value := os.Getenv(env); value != "" {
+			ttls[visibility], err = time.ParseDuration(value)
+			if err != nil || ttls[visibility] <= 0 {
+				log.Fatalf("%s must be a positive duration like 15m: %v", env, err)
+			}
+		}
+	}
+
+	defaultQuota := userQuota{
+		Bytes:              10 << 30,
+		Videos:             100,
+		MonthlyUploadBytes: 20 << 30,
+	}
+	for limit, env := range map[*int64]string{
+		&defaultQuota.Bytes:              "DEFAULT_QUOTA_BYTES",
+		&defaultQuota.Videos:             "DEFAULT_QUOTA_VIDEOS",
+		&defaultQuota.MonthlyUploadBytes: "DEFAULT_QUOTA_MONTHLY_UPLOAD_BYTES",
+	} {
+		if value := os.Getenv(env); value != "" {
+			*limit, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || *limit < 0 {
+				log.Fatalf("%s must be a non-negative integer: %v", env, err)
+			}
+		}
+	}
+
+	// TRUST_PROXY is the number of proxies in front of the server, with
+	// "true" meaning one.
+	var trustedProxies int
+	switch value := os.Getenv("TRUST_PROXY"); value {
+	case "", "false":
+	case "true":
+		trustedProxies = 1
+	default:
+		trustedProxies, err = strconv.Atoi(value)
+		if err != nil || trustedProxies < 0 {
+			log.Fatalf("TRUST_PROXY must be true, false or a number of proxies: %v", err)
+		}
+	}
+
+	// Links in emails point here, so it must be the address users reach
+	// the app on.
+	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + port
+	}
+
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "Tubely <no-reply@localhost>"
+	}
+	var mail mailer.Mailer
+	switch os.Getenv("MAILER") {
+	case "", "log":
+		var w io.Writer = os.Stderr
+		if path := os.Getenv("MAIL_LOG_PATH"); path != "" {
+			w, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				log.Fatalf("Couldn't open MAIL_LOG_PATH: %v", err)
+			}
+		}
+		mail = mailer.NewLogMailer(w, mailFrom)
+	case "smtp":
+		smtpHost := os.Getenv("SMTP_HOST")
+		if smtpHost == "" {
+			log.Fatal("SMTP_HOST must be set when MAILER is smtp")
+		}
+		smtpPort := os.Getenv("SMTP_PORT")
+		if smtpPort == "" {
+			smtpPort = "587"
+		}
+		mail, err = mailer.NewSMTPMailer(smtpHost, smtpPort, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), mailFrom)
+		if err != nil {
+			log.Fatalf("MAIL_FROM must be an email address: %v", err)
+		}
+	default:
+		log.Fatal("MAILER must be log or smtp")
+	}
+
+	var oidcProvider *oidc.Provider
+	if oidcIssuer := os.Getenv("OIDC_ISSUER_URL"); oidcIssuer != "" {
+		oidcClientID := os.Getenv("OIDC_CLIENT_ID")
+		if oidcClientID == "" {
+			log.Fatal("OIDC_CLIENT_ID must be set when OIDC_ISSUER_URL is")
+		}
+		oidcRedirectURL := os.Getenv("OIDC_REDIRECT_URL")
+		if oidcRedirectURL == "" {
+			oidcRedirectURL = baseURL + "/api/oidc/callback"
+		}
+		oidcProvider = oidc.NewProvider(oidcIssuer, oidcClientID, os.Getenv("OIDC_CLIENT_SECRET"), oidcRedirectURL)
+	}
+
+	var cfSigner *sign.URLSigner
+	cfKeyPairID := os.Getenv("CF_KEY_PAIR_ID")
+	cfPrivateKeyPath := os.Getenv("CF_PRIVATE_KEY_PATH")
+	if cfKeyPairID != "" || cfPrivateKeyPath != "" {
+		if cfKeyPairID == "" || cfPrivateKeyPath == "" {
+			log.Fatal("CF_KEY_PAIR_ID and CF_PRIVATE_KEY_PATH must be set together")
+		}
+		cfSigner, err = newCloudFrontSigner(cfKeyPairID, cfPrivateKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't load CloudFront signing key: %v", err)
+		}
+	}
+
 	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
 	if err != nil {
-		log.Fatal("Failed loading S3 config: %v", err)
+		log.Fatalf("Failed loading S3 config: %v", err)
 	}
 
 	s3Client := s3.NewFromConfig(s3Config)
 
 	cfg := apiConfig{
 		db:               db,
-		jwtSecret:        jwtSecret,
+		jwtKeys:          jwtKeys,
 		platform:         platform,
 		filepathRoot:     filepathRoot,
 		assetsRoot:       assetsRoot,
@@ -98,6 +291,21 @@ func main() {
 		s3Client:         s3Client,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
+		trashRetention:   trashRetention,
+		gcGracePeriod:    gcGracePeriod,
+		gcDelete:         os.Getenv("GC_DELETE") == "true",
+		playbackTTLs:     ttls,
+		cfSigner:         cfSigner,
+		assetETags:       newAssetETagCache(),
+		defaultQuota:     defaultQuota,
+		rateLimiter:      ratelimit.NewMemoryStore(),
+		trustedProxies:   trustedProxies,
+		accessTokenTTL:   accessTokenTTL,
+		refreshTokenTTL:  refreshTokenTTL,
+		mailer:           mail,
+		baseURL:          baseURL,
+		oidc:             oidcProvider,
+		userDeletions:    make(chan struct{}, 1),
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -105,27 +313,97 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gc":
+			if err := cfg.runGCCommand(os.Args[2:]); err != nil {
+				log.Fatalf("gc failed: %v", err)
+			}
+		case "promote-admin":
+			if err := cfg.runPromoteAdminCommand(os.Args[2:]); err != nil {
+				log.Fatalf("promote-admin failed: %v", err)
+			}
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	go cfg.runUploadRecovery(15 * time.Minute)
+	go cfg.runTrashPurger(time.Hour)
+	go cfg.runUserDeleter(15 * time.Minute)
+	if gcInterval > 0 {
+		go cfg.runGarbageCollector(gcInterval)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	mux.HandleFunc("GET /assets/", cfg.handlerAssets)
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
+
+	// API responses reflect mutable state, so they must never be cached.
+	apiMux := http.NewServeMux()
+	mux.Handle("/api/", noCacheMiddleware(apiMux))
+	mux.Handle("/admin/", noCacheMiddleware(apiMux))
+
+	apiMux.HandleFunc("POST /api/login", cfg.rateLimit("login", cfg.handlerLogin))
+	apiMux.HandleFunc("POST /api/login/mfa", cfg.rateLimit("mfa", cfg.handlerLoginMFA))
+	apiMux.HandleFunc("POST /api/login/oidc", cfg.rateLimit("token", cfg.handlerLoginOIDC))
+	apiMux.HandleFunc("GET /api/oidc/login", cfg.rateLimit("login", cfg.handlerOIDCLogin))
+	apiMux.HandleFunc("GET /api/oidc/callback", cfg.rateLimit("token", cfg.handlerOIDCCallback))
+	apiMux.HandleFunc("POST /api/refresh", cfg.rateLimit("refresh", cfg.handlerRefresh))
+	apiMux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	apiMux.HandleFunc("GET /api/sessions", cfg.requireAccessToken(cfg.handlerSessionsGet))
+	apiMux.HandleFunc("DELETE /api/sessions", cfg.requireAccessToken(cfg.handlerSessionsRevokeAll))
+	apiMux.HandleFunc("DELETE /api/sessions/{sessionID}", cfg.requireAccessToken(cfg.handlerSessionRevoke))
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	apiMux.HandleFunc("POST /api/api_keys", cfg.requireAccessToken(cfg.handlerAPIKeysCreate))
+	apiMux.HandleFunc("GET /api/api_keys", cfg.requireAccessToken(cfg.handlerAPIKeysGet))
+	apiMux.HandleFunc("DELETE /api/api_keys/{keyID}", cfg.requireAccessToken(cfg.handlerAPIKeyRevoke))
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	apiMux.HandleFunc("POST /api/users", cfg.rateLimit("signup", cfg.handlerUsersCreate))
+	apiMux.HandleFunc("POST /api/users/verify", cfg.rateLimit("token", cfg.handlerVerifyEmail))
+	apiMux.HandleFunc("GET /api/users/me", cfg.requireAuth(database.APIKeyScopeRead, cfg.handlerUsersMeGet))
+	apiMux.HandleFunc("PATCH /api/users/me", cfg.requireAccessToken(cfg.rateLimit("mfa", cfg.handlerUsersMeUpdate)))
+	apiMux.HandleFunc("DELETE /api/users/me", cfg.requireAccessToken(cfg.rateLimit("mfa", cfg.handlerUsersDelete)))
+	apiMux.HandleFunc("POST /api/users/me/avatar", cfg.requireAccessToken(cfg.rateLimit("upload", cfg.handlerAvatarUpload)))
+	apiMux.HandleFunc("DELETE /api/users/me/avatar", cfg.requireAccessToken(cfg.handlerAvatarDelete))
+	apiMux.HandleFunc("PUT /api/users/me/password", cfg.requireAccessToken(cfg.rateLimit("mfa", cfg.handlerPasswordChange)))
+	apiMux.HandleFunc("POST /api/users/me/verify", cfg.requireAccessToken(cfg.rateLimit("email", cfg.handlerVerifyEmailResend)))
+	apiMux.HandleFunc("POST /api/password_reset", cfg.rateLimit("email", cfg.handlerPasswordResetRequest))
+	apiMux.HandleFunc("POST /api/email_change/confirm", cfg.rateLimit("token", cfg.handlerEmailChangeConfirm))
+	apiMux.HandleFunc("POST /api/password_reset/confirm", cfg.rateLimit("token", cfg.handlerPasswordResetConfirm))
+	apiMux.HandleFunc("POST /api/users/me/mfa/totp", cfg.requireAccessToken(cfg.rateLimit("mfa", cfg.handlerTOTPEnroll)))
+	apiMux.HandleFunc("POST /api/users/me/mfa/totp/confirm", cfg.requireAccessToken(cfg.rateLimit("mfa", cfg.handlerTOTPConfirm)))
+	apiMux.HandleFunc("DELETE /api/users/me/mfa/totp", cfg.requireAccessToken(cfg.rateLimit("mfa", cfg.handlerTOTPDisable)))
+	apiMux.HandleFunc("GET /api/users/me/auth_events", cfg.requireAccessToken(cfg.handlerAuthEventsGet))
+	apiMux.HandleFunc("GET /api/users/me/usage", cfg.requireAuth(database.APIKeyScopeRead, cfg.handlerUsageGet))
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	apiMux.HandleFunc("POST /api/videos", cfg.requireAuth(database.APIKeyScopeUpload, cfg.handlerVideoMetaCreate))
+	apiMux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.requireAuth(database.APIKeyScopeUpload, cfg.rateLimit("upload", cfg.handlerUploadThumbnail)))
+	apiMux.HandleFunc("POST /api/video_upload/{videoID}", cfg.requireAuth(database.APIKeyScopeUpload, cfg.rateLimit("upload", cfg.handlerUploadVideo)))
+	apiMux.HandleFunc("GET /api/videos", cfg.requireAuth(database.APIKeyScopeRead, cfg.handlerVideosRetrieve))
+	apiMux.HandleFunc("GET /api/videos/search", cfg.requireAuth(database.APIKeyScopeRead, cfg.handlerVideosSearch))
+	apiMux.HandleFunc("GET /api/videos/trash", cfg.requireAuth(database.APIKeyScopeRead, cfg.handlerVideosTrash))
+	apiMux.HandleFunc("GET /api/videos/public", cfg.handlerVideosPublic)
+	apiMux.HandleFunc("GET /api/videos/{videoID}", cfg.optionalAuth(database.APIKeyScopeRead, cfg.handlerVideoGet))
+	apiMux.HandleFunc("PATCH /api/videos/{videoID}", cfg.requireAuth(database.APIKeyScopeUpload, cfg.handlerVideoMetaUpdate))
+	apiMux.HandleFunc("DELETE /api/videos/{videoID}", cfg.requireAuth(database.APIKeyScopeDelete, cfg.handlerVideoMetaDelete))
+	apiMux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.requireAuth(database.APIKeyScopeDelete, cfg.handlerVideoRestore))
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	apiMux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	apiMux.HandleFunc("GET /admin/status", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminStatus))
+	apiMux.HandleFunc("GET /admin/auth_events", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminAuthEventsGet))
+	apiMux.HandleFunc("GET /admin/users", cfg.requireRole(database.RoleModerator, cfg.handlerAdminUsersGet))
+	apiMux.HandleFunc("POST /admin/users/{userID}/disable", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminUserDisable))
+	apiMux.HandleFunc("POST /admin/users/{userID}/enable", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminUserEnable))
+	apiMux.HandleFunc("POST /admin/users/{userID}/unlock", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminUserUnlock))
+	apiMux.HandleFunc("POST /admin/users/{userID}/mfa/reset", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminUserMFAReset))
+	apiMux.HandleFunc("PUT /admin/users/{userID}/role", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminUserRole))
+	apiMux.HandleFunc("POST /admin/videos/{videoID}/transfer", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminVideoTransfer))
+	apiMux.HandleFunc("DELETE /admin/videos/{videoID}", cfg.requireRole(database.RoleModerator, cfg.handlerAdminVideoDelete))
 
 	srv := &http.Server{
 		Addr:    ":" + port,
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newTestConfig returns a config backed by a fresh database, with only
+// what the handlers under test need.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{
+		db:      db,
+		baseURL: "http://localhost:8091",
+	}
+}
+
+// createTestUser creates a user with password, or without one if it's
+// empty, like users who only log in with single sign-on.
+func createTestUser(t *testing.T, cfg *apiConfig, email, password string) uuid.UUID {
+	t.Helper()
+	hash := ""
+	if password != "" {
+		var err error
+		hash, err = auth.HashPassword(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: email, Password: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+// newUserRequest returns a request made with an access token for userID's
+// session, as requireAccessToken would pass it on.
+func newUserRequest(method, target, body string, userID uuid.UUID, sessionID string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	p := principal{
+		UserID:    userID,
+		Role:      database.RoleUser,
+		Method:    authMethodAccessToken,
+		SessionID: sessionID,
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+}
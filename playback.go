@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// playbackTTLs is how long a minted playback URL stays valid, per
+// visibility level.
+type playbackTTLs map[database.Visibility]time.Duration
+
+func (cfg *apiConfig) playbackTTL(visibility database.Visibility) time.Duration {
+	if ttl, ok := cfg.playbackTTLs[visibility]; ok {
+		return ttl
+	}
+	return cfg.playbackTTLs[database.VisibilityPrivate]
+}
+
+// generatePresignedURL returns a URL that lets the holder GET the object
+// directly from the bucket until it expires.
+func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
+	presignClient := s3.NewPresignClient(s3Client)
+	req, err := presignClient.PresignGetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expireTime))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// signPlaybackURL mints a short-lived URL for a stored video key. It uses a
+// CloudFront signed URL when a key pair is configured, and an S3 presigned
+// URL otherwise.
+func (cfg *apiConfig) signPlaybackURL(key string, ttl time.Duration) (string, error) {
+	if cfg.cfSigner == nil {
+		return generatePresignedURL(cfg.s3Client, cfg.s3Bucket, key, ttl)
+	}
+	rawURL := (&url.URL{Scheme: "https", Host: cfg.s3CfDistribution, Path: "/" + key}).String()
+	return cfg.cfSigner.Sign(rawURL, time.Now().Add(ttl))
+}
+
+// dbVideoToSignedVideo replaces the stored video key with a playback URL
+// that expires according to the video's visibility.
+func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
+	if video.VideoURL == nil {
+		return video, nil
+	}
+	key, ok := cfg.videoKeyFromStored(*video.VideoURL)
+	if !ok {
+		return video, nil
+	}
+	signed, err := cfg.signPlaybackURL(key, cfg.playbackTTL(video.Visibility))
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't sign playback URL for video %s: %w", video.ID, err)
+	}
+	video.VideoURL = &signed
+	return video, nil
+}
+
+func (cfg *apiConfig) dbVideosToSignedVideos(videos []database.Video) ([]database.Video, error) {
+	signed := make([]database.Video, len(videos))
+	for i, video := range videos {
+		var err error
+		signed[i], err = cfg.dbVideoToSignedVideo(video)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return signed, nil
+}
+
+// newCloudFrontSigner loads the RSA key of a CloudFront key pair. Keys
+// downloaded from AWS are PKCS #1, but `openssl genrsa` writes PKCS #8, so
+// both are accepted.
+func newCloudFrontSigner(keyPairID, privateKeyPath string) (*sign.URLSigner, error) {
+	dat, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		key, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, err
+		}
+		var ok bool
+		privateKey, ok = key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("CloudFront signing keys must be RSA")
+		}
+	}
+	return sign.NewURLSigner(keyPairID, privateKey), nil
+}
+
+// respondWithVideo responds with a video whose playback URL has been signed.
+func (cfg *apiConfig) respondWithVideo(w http.ResponseWriter, code int, video database.Video) {
+	signed, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+	respondWithJSON(w, code, signed)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var (
+	errInvalidAPIKey   = errors.New("invalid API key")
+	errAccountDisabled = errors.New("account is disabled")
+	errSessionRevoked  = errors.New("session has ended")
+)
+
+// authMethod is how a request was authenticated.
+type authMethod string
+
+const (
+	authMethodAccessToken authMethod = "access_token"
+	authMethodAPIKey      authMethod = "api_key"
+)
+
+// principal is who a request was made by.
+type principal struct {
+	UserID uuid.UUID
+	Role   database.Role
+	Method authMethod
+	// Scopes limits what an API key can do. Access tokens can do anything.
+	Scopes    []database.APIKeyScope
+	SessionID string
+	APIKeyID  uuid.UUID
+}
+
+func (p principal) hasScope(scope database.APIKeyScope) bool {
+	if scope == "" || p.Method == authMethodAccessToken {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+// requestPrincipal returns who made a request, or false for anonymous
+// requests. It's set by the auth middlewares.
+func requestPrincipal(r *http.Request) (principal, bool) {
+	p, ok := r.Context().Value(principalContextKey{}).(principal)
+	return p, ok
+}
+
+// authenticateRequest identifies who made a request from either an
+// `Authorization: Bearer` access token or an `Authorization: ApiKey` API
+// key. It returns auth.ErrNoAuthHeaderIncluded for anonymous requests.
+// The user and the access token's session are looked up on every request,
+// so disabling the user, changing their role or logging out takes effect
+// immediately.
+func (cfg *apiConfig) authenticateRequest(r *http.Request) (principal, error) {
+	p, err := cfg.parseCredentials(r)
+	if err != nil {
+		return principal{}, err
+	}
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		return principal{}, err
+	}
+	if user == nil {
+		return principal{}, errors.New("user no longer exists")
+	}
+	if user.DisabledAt != nil {
+		return principal{}, errAccountDisabled
+	}
+	if p.Method == authMethodAccessToken {
+		session, err := cfg.db.GetSession(p.SessionID)
+		if err != nil {
+			return principal{}, err
+		}
+		if session.UserID != p.UserID || session.RevokedAt != nil {
+			return principal{}, errSessionRevoked
+		}
+	}
+	p.Role = user.Role
+	return p, nil
+}
+
+func (cfg *apiConfig) parseCredentials(r *http.Request) (principal, error) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "ApiKey ") {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			return principal{}, err
+		}
+		accessToken, err := auth.ParseAccessToken(token, cfg.jwtKeys)
+		if err != nil {
+			return principal{}, err
+		}
+		return principal{
+			UserID:    accessToken.UserID,
+			Method:    authMethodAccessToken,
+			SessionID: accessToken.SessionID,
+		}, nil
+	}
+
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return principal{}, err
+	}
+	apiKey, err := cfg.db.GetAPIKeyByHash(auth.HashAPIKey(key))
+	if err != nil {
+		return principal{}, err
+	}
+	if apiKey.ID == uuid.Nil {
+		return principal{}, errInvalidAPIKey
+	}
+	if err := cfg.db.TouchAPIKey(apiKey.ID); err != nil {
+		log.Printf("Couldn't record use of API key %s: %v", apiKey.ID, err)
+	}
+	return principal{
+		UserID:   apiKey.UserID,
+		Method:   authMethodAPIKey,
+		Scopes:   apiKey.Scopes,
+		APIKeyID: apiKey.ID,
+	}, nil
+}
+
+// withPrincipal authenticates the request and passes it on with its
+// principal in the context. Requests without credentials are rejected if
+// required is set and passed on anonymously otherwise; requests with bad
+// credentials, or with an API key missing scope, are always rejected.
+func (cfg *apiConfig) withPrincipal(scope database.APIKeyScope, required bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := cfg.authenticateRequest(r)
+		if errors.Is(err, auth.ErrNoAuthHeaderIncluded) && !required {
+			next(w, r)
+			return
+		}
+		if errors.Is(err, errAccountDisabled) {
+			respondWithError(w, http.StatusForbidden, "Your account is disabled", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate credentials", err)
+			return
+		}
+		if !p.hasScope(scope) {
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("API key doesn't have the %s scope", scope), nil)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p)))
+	}
+}
+
+// requireAuth only lets authenticated requests through. API keys must have
+// been granted scope, if one is given.
+func (cfg *apiConfig) requireAuth(scope database.APIKeyScope, next http.HandlerFunc) http.HandlerFunc {
+	return cfg.withPrincipal(scope, true, next)
+}
+
+// optionalAuth lets anonymous requests through, but authenticates those
+// with credentials.
+func (cfg *apiConfig) optionalAuth(scope database.APIKeyScope, next http.HandlerFunc) http.HandlerFunc {
+	return cfg.withPrincipal(scope, false, next)
+}
+
+// requireAccessToken only lets requests from a logged in user through, for
+// managing the account's credentials. API keys can't be used, so a leaked
+// key can't mint more.
+func (cfg *apiConfig) requireAccessToken(next http.HandlerFunc) http.HandlerFunc {
+	return cfg.requireAuth("", func(w http.ResponseWriter, r *http.Request) {
+		p, _ := requestPrincipal(r)
+		if p.Method != authMethodAccessToken {
+			respondWithError(w, http.StatusForbidden, "This requires logging in, API keys can't be used", nil)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireRole only lets logged in users with at least role through.
+func (cfg *apiConfig) requireRole(role database.Role, next http.HandlerFunc) http.HandlerFunc {
+	return cfg.requireAccessToken(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := requestPrincipal(r)
+		if !p.Role.AtLeast(role) {
+			respondWithError(w, http.StatusForbidden, "You don't have permission to do that", nil)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// authorizeOwner checks that p may act on something owned by ownerID,
+// responding with 403 if not.
+func authorizeOwner(w http.ResponseWriter, p principal, ownerID uuid.UUID) bool {
+	if p.UserID != ownerID {
+		respondWithError(w, http.StatusForbidden, "You don't have permission to do that", nil)
+		return false
+	}
+	return true
+}
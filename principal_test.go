@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func TestAuthenticateRequestRevokedSession(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.jwtKeys = auth.NewHMACKeySet("secret")
+	cfg.accessTokenTTL = time.Hour
+	cfg.refreshTokenTTL = time.Hour
+	userID := createTestUser(t, cfg, "boots@example.com", "password")
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticate := func(token string) error {
+		r := httptest.NewRequest(http.MethodGet, "/api/videos", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := cfg.authenticateRequest(r)
+		return err
+	}
+
+	tests := []struct {
+		name   string
+		revoke func(sessionID string) error
+	}{
+		{name: "log out", revoke: cfg.db.RevokeSession},
+		{name: "log out everywhere", revoke: func(string) error { return cfg.db.RevokeUserSessions(userID) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := cfg.startSession(httptest.NewRequest(http.MethodPost, "/api/login", nil), *user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := authenticate(token); err != nil {
+				t.Fatalf("fresh token: %v", err)
+			}
+			accessToken, err := auth.ParseAccessToken(token, cfg.jwtKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.revoke(accessToken.SessionID); err != nil {
+				t.Fatal(err)
+			}
+			if err := authenticate(token); !errors.Is(err, errSessionRevoked) {
+				t.Errorf("err = %v, want %v", err, errSessionRevoked)
+			}
+		})
+	}
+}
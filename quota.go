@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// userQuota is a user's quota with the configured defaults filled in. A
+// limit of zero means unlimited.
+type userQuota struct {
+	Bytes              int64 `json:"bytes"`
+	Videos             int64 `json:"videos"`
+	MonthlyUploadBytes int64 `json:"monthly_upload_bytes"`
+}
+
+func (cfg *apiConfig) getUserQuota(userID uuid.UUID) (userQuota, error) {
+	override, err := cfg.db.GetQuota(userID)
+	if err != nil {
+		return userQuota{}, err
+	}
+	quota := cfg.defaultQuota
+	if override.Bytes != nil {
+		quota.Bytes = *override.Bytes
+	}
+	if override.Videos != nil {
+		quota.Videos = *override.Videos
+	}
+	if override.MonthlyUploadBytes != nil {
+		quota.MonthlyUploadBytes = *override.MonthlyUploadBytes
+	}
+	return quota, nil
+}
+
+// checkVideoQuota reports errQuotaExceeded if the user can't create another
+// video.
+func (cfg *apiConfig) checkVideoQuota(userID uuid.UUID) error {
+	quota, err := cfg.getUserQuota(userID)
+	if err != nil {
+		return err
+	}
+	usage, err := cfg.db.GetUsage(userID)
+	if err != nil {
+		return err
+	}
+	if quota.Videos > 0 && usage.VideoCount >= quota.Videos {
+		return fmt.Errorf("%w: limit of %d videos reached", errQuotaExceeded, quota.Videos)
+	}
+	return nil
+}
+
+// checkUploadQuota reports errQuotaExceeded if uploading size bytes in place
+// of replaced bytes would take the user over their storage or monthly
+// upload limit.
+func (cfg *apiConfig) checkUploadQuota(userID uuid.UUID, size, replaced int64) error {
+	quota, err := cfg.getUserQuota(userID)
+	if err != nil {
+		return err
+	}
+	usage, err := cfg.db.GetUsage(userID)
+	if err != nil {
+		return err
+	}
+	if quota.Bytes > 0 && usage.BytesStored-replaced+size > quota.Bytes {
+		return fmt.Errorf("%w: storage limit of %d bytes reached", errQuotaExceeded, quota.Bytes)
+	}
+	if quota.MonthlyUploadBytes > 0 && usage.MonthlyUploadBytes+size > quota.MonthlyUploadBytes {
+		return fmt.Errorf("%w: monthly upload limit of %d bytes reached", errQuotaExceeded, quota.MonthlyUploadBytes)
+	}
+	return nil
+}
+
+// respondWithQuotaError responds to a failed quota check with status if the
+// quota was exceeded, or a 500 if the check itself failed.
+func respondWithQuotaError(w http.ResponseWriter, status int, err error) {
+	if errors.Is(err, errQuotaExceeded) {
+		respondWithError(w, status, err.Error(), err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Couldn't check quota", err)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+)
+
+// rateLimitPolicy limits requests per client IP and, when the request
+// carries valid credentials, per user. A zero limit is not enforced.
+type rateLimitPolicy struct {
+	perIP   ratelimit.Limit
+	perUser ratelimit.Limit
+}
+
+// rateLimitPolicies holds the limits for every rate limited route, keyed by
+// the name passed to rateLimit.
+var rateLimitPolicies = map[string]rateLimitPolicy{
+	"login": {
+		perIP: ratelimit.Limit{Burst: 10, Period: time.Minute},
+	},
+	// Endpoints that check a two-factor code, which is short enough to
+	// guess without a limit, or re-check a logged in user's password.
+	"mfa": {
+		perIP:   ratelimit.Limit{Burst: 10, Period: time.Minute},
+		perUser: ratelimit.Limit{Burst: 10, Period: time.Minute},
+	},
+	"refresh": {
+		perIP: ratelimit.Limit{Burst: 30, Period: time.Minute},
+	},
+	"signup": {
+		perIP: ratelimit.Limit{Burst: 5, Period: time.Hour},
+	},
+	// Endpoints that send email, so they can't be used to flood inboxes.
+	"email": {
+		perIP:   ratelimit.Limit{Burst: 10, Period: time.Hour},
+		perUser: ratelimit.Limit{Burst: 5, Period: time.Hour},
+	},
+	// Endpoints that take a token from an email.
+	"token": {
+		perIP: ratelimit.Limit{Burst: 30, Period: time.Minute},
+	},
+	"upload": {
+		perIP:   ratelimit.Limit{Burst: 60, Period: time.Hour},
+		perUser: ratelimit.Limit{Burst: 30, Period: time.Hour},
+	},
+}
+
+// rateLimit wraps next with the named policy. Requests over either limit
+// are rejected with 429 and a Retry-After header, and every response
+// carries RateLimit-* headers for the limit closest to running out. The
+// per-user limit needs the request authenticated first.
+func (cfg *apiConfig) rateLimit(name string, next http.HandlerFunc) http.HandlerFunc {
+	policy, ok := rateLimitPolicies[name]
+	if !ok {
+		log.Fatalf("Unknown rate limit policy %q", name)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := []string{name + ":ip:" + cfg.clientIP(r)}
+		limits := []ratelimit.Limit{policy.perIP}
+		if p, ok := requestPrincipal(r); ok && !policy.perUser.IsZero() {
+			keys = append(keys, name+":user:"+p.UserID.String())
+			limits = append(limits, policy.perUser)
+		}
+
+		var closest *ratelimit.Result
+		for i, key := range keys {
+			if limits[i].IsZero() {
+				continue
+			}
+			result, err := cfg.rateLimiter.Take(r.Context(), key, limits[i])
+			if err != nil {
+				// Don't lock everyone out because the store is down.
+				log.Printf("Couldn't check rate limit %s: %v", key, err)
+				continue
+			}
+			if closest == nil || !result.Allowed || (closest.Allowed && result.Remaining < closest.Remaining) {
+				closest = &result
+			}
+			if !result.Allowed {
+				break
+			}
+		}
+
+		if closest != nil {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(closest.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(closest.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(closest.Reset)))
+			if !closest.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(closest.RetryAfter)))
+				respondWithError(w, http.StatusTooManyRequests, "Too many requests, try again later", nil)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// clientIP returns the address the request came from. X-Forwarded-For is
+// only trusted when running behind proxies, and then only the entries they
+// appended: clients can send the header with whatever they like in it, so
+// the address is counted back from the right by the number of proxies.
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	if cfg.trustedProxies > 0 {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		if len(hops) > 0 {
+			return hops[max(len(hops)-cfg.trustedProxies, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
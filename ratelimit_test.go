@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies int
+		forwardedFor   []string
+		want           string
+	}{
+		{name: "no proxy", want: "192.0.2.1"},
+		{name: "no proxy ignores the header", forwardedFor: []string{"198.51.100.7"}, want: "192.0.2.1"},
+		{name: "one proxy", trustedProxies: 1, forwardedFor: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "one proxy, spoofed entry", trustedProxies: 1, forwardedFor: []string{"10.0.0.1, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "one proxy, spoofed header", trustedProxies: 1, forwardedFor: []string{"10.0.0.1", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "two proxies", trustedProxies: 2, forwardedFor: []string{"10.0.0.1, 198.51.100.7, 203.0.113.9"}, want: "198.51.100.7"},
+		{name: "fewer entries than proxies", trustedProxies: 3, forwardedFor: []string{"198.51.100.7, 203.0.113.9"}, want: "198.51.100.7"},
+		{name: "empty entries", trustedProxies: 1, forwardedFor: []string{"198.51.100.7, "}, want: "198.51.100.7"},
+		{name: "proxy without the header", trustedProxies: 1, want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &apiConfig{trustedProxies: tt.trustedProxies}
+			r := httptest.NewRequest("GET", "/api/login", nil)
+			r.RemoteAddr = "192.0.2.1:54321"
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := cfg.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// reauthWindow is how recently a user without a password must have logged
+// in for their session to count as proof of who they are.
+const reauthWindow = 5 * time.Minute
+
+// reauthParams are the credentials a user gives to confirm a sensitive
+// change to their account.
+type reauthParams struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// reauthenticate checks that whoever holds a user's access token is really
+// them: by their password, or by having just logged in if they only use
+// single sign-on, and by a second factor if they have one. Wrong answers
+// count as failed logins. It responds with an error and returns false if
+// the check fails.
+func (cfg *apiConfig) reauthenticate(w http.ResponseWriter, r *http.Request, user database.User, params reauthParams) bool {
+	if isLocked(user) {
+		cfg.recordAuthEvent(r, user.ID, database.AuthEventLoginFailed, "locked")
+		respondWithLocked(w, user)
+		return false
+	}
+
+	if user.Password != "" {
+		match, err := auth.CheckPasswordHash(params.Password, user.Password)
+		if err != nil || !match {
+			cfg.recordLoginFailure(r, user, "password")
+			respondWithError(w, http.StatusForbidden, "Incorrect password", err)
+			return false
+		}
+	} else {
+		p, _ := requestPrincipal(r)
+		session, err := cfg.db.GetSession(p.SessionID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get session", err)
+			return false
+		}
+		if session.ID == "" || time.Since(session.CreatedAt) > reauthWindow {
+			respondWithError(w, http.StatusForbidden, "Log in again to confirm this change", nil)
+			return false
+		}
+	}
+
+	if user.TOTPEnabledAt != nil {
+		ok, err := cfg.checkSecondFactor(user.ID, params.Code, params.RecoveryCode)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+			return false
+		}
+		if !ok {
+			cfg.recordLoginFailure(r, user, "mfa")
+			respondWithError(w, http.StatusForbidden, "Incorrect code", nil)
+			return false
+		}
+	}
+	return true
+}
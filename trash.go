@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// purgeVideo permanently deletes a video that was moved to the trash
+// before deletedBefore. Its references on assets are released and the
+// assets nothing else uses are deleted before the row itself, so a failure
+// part way leaves the row in place for the next run to retry. A video
+// restored in the meantime is left alone and database.ErrVideoNotTrashed
+// is returned.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video, deletedBefore time.Time) error {
+	released, err := cfg.db.ReleaseVideoAssets(video.ID, deletedBefore)
+	if err != nil {
+		return fmt.Errorf("couldn't release assets: %w", err)
+	}
+	if err := cfg.releaseAssets(ctx, released); err != nil {
+		return err
+	}
+
+	// Objects stored before assets were recorded are only known through
+	// their uploads or the video's URLs, and are never shared.
+	uploads, err := cfg.db.GetVideoUploads(video.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't list uploads: %w", err)
+	}
+	objects := map[string]database.UploadKind{}
+	for _, upload := range uploads {
+		objects[upload.Key] = upload.Kind
+	}
+	if video.ThumbnailURL != nil {
+		if key, ok := cfg.assetKeyFromURL(*video.ThumbnailURL); ok {
+			objects[key] = database.UploadKindThumbnail
+		}
+	}
+	if video.VideoURL != nil {
+		if key, ok := cfg.videoKeyFromStored(*video.VideoURL); ok {
+			objects[key] = database.UploadKindVideo
+		}
+	}
+
+	for key, kind := range objects {
+		asset, err := cfg.db.GetAsset(kind, key)
+		if err != nil {
+			return fmt.Errorf("couldn't get asset %s: %w", key, err)
+		}
+		if asset.Key != "" {
+			continue
+		}
+		if err := cfg.deleteObject(ctx, kind, key); err != nil {
+			return fmt.Errorf("couldn't delete %s object %s: %w", kind, key, err)
+		}
+	}
+
+	return cfg.db.DeleteVideo(video.ID, deletedBefore)
+}
+
+// purgeTrash permanently deletes videos that have been in the trash for
+// longer than the retention period.
+func (cfg *apiConfig) purgeTrash() {
+	cutoff := time.Now().Add(-cfg.trashRetention)
+	videos, err := cfg.db.GetTrashedVideos(cutoff)
+	if err != nil {
+		log.Printf("Couldn't list trashed videos: %v", err)
+		return
+	}
+	for _, video := range videos {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := cfg.purgeVideo(ctx, video, cutoff)
+		cancel()
+		if errors.Is(err, database.ErrVideoNotTrashed) {
+			log.Printf("Video %s was restored before it could be purged", video.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Couldn't purge video %s: %v", video.ID, err)
+			continue
+		}
+		log.Printf("Purged video %s deleted at %s", video.ID, video.DeletedAt.Format(time.RFC3339))
+	}
+}
+
+func (cfg *apiConfig) runTrashPurger(interval time.Duration) {
+	for {
+		cfg.purgeTrash()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// pendingUploadTimeout is how long an upload may stay pending before it is
+// assumed abandoned by a crashed or killed request and rolled back.
+const pendingUploadTimeout = time.Hour
+
+func (cfg *apiConfig) deleteObject(ctx context.Context, kind database.UploadKind, key string) error {
+	switch kind {
+	case database.UploadKindThumbnail:
+		err := os.Remove(cfg.getAssetDiskPath(key))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	case database.UploadKindVideo:
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(cfg.s3Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	default:
+		return fmt.Errorf("unknown upload kind %q", kind)
+	}
+}
+
+// stageUpload records a pending upload of a content-addressed object and
+// reports whether the object still has to be written. Content that is
+// already stored and referenced is not written again.
+func (cfg *apiConfig) stageUpload(params database.CreateUploadParams) (database.Upload, bool, error) {
+	upload, err := cfg.db.CreateUpload(params)
+	if err != nil {
+		return database.Upload{}, false, err
+	}
+
+	asset, err := cfg.db.GetAsset(params.Kind, params.Key)
+	if err != nil {
+		cfg.abortUpload(upload)
+		return database.Upload{}, false, err
+	}
+	// An unreferenced asset may be deleted at any moment, so only
+	// referenced ones can be relied on.
+	return upload, asset.RefCount == 0, nil
+}
+
+// abortUpload is the compensating action for a pending upload whose object
+// may have been written but will never be referenced by its video. The
+// object is kept if other videos or uploads use the same content.
+func (cfg *apiConfig) abortUpload(upload database.Upload) {
+	// The request context may already be cancelled, which is often why
+	// we're aborting in the first place.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	inUse, err := cfg.db.IsAssetInUse(upload.Kind, upload.Key, upload.ID)
+	if err != nil {
+		log.Printf("Couldn't check whether object %s is in use: %v", upload.Key, err)
+		return
+	}
+	if !inUse {
+		if err := cfg.deleteObject(ctx, upload.Kind, upload.Key); err != nil {
+			log.Printf("Couldn't delete object %s for aborted upload %s: %v", upload.Key, upload.ID, err)
+			return
+		}
+		if _, err := cfg.db.DeleteAsset(upload.Kind, upload.Key, upload.ID); err != nil {
+			log.Printf("Couldn't delete asset record %s: %v", upload.Key, err)
+		}
+	}
+	if err := cfg.db.FailUpload(upload.ID); err != nil {
+		log.Printf("Couldn't mark upload %s as failed: %v", upload.ID, err)
+	}
+}
+
+// releaseAssets deletes assets whose last reference was dropped. An asset
+// that gained a new reference in the meantime, or that an upload is
+// staging again, is left alone.
+func (cfg *apiConfig) releaseAssets(ctx context.Context, assets []database.Asset) error {
+	for _, asset := range assets {
+		deleted, err := cfg.db.DeleteAsset(asset.Kind, asset.Key, uuid.Nil)
+		if err != nil {
+			return fmt.Errorf("couldn't delete asset record %s: %w", asset.Key, err)
+		}
+		if !deleted {
+			continue
+		}
+		if err := cfg.deleteObject(ctx, asset.Kind, asset.Key); err != nil {
+			return fmt.Errorf("couldn't delete %s object %s: %w", asset.Kind, asset.Key, err)
+		}
+	}
+	return nil
+}
+
+// releaseReplacedAssets is releaseAssets for the assets an upload replaced.
+// The upload has already succeeded, so failures are only logged and left
+// for garbage collection.
+func (cfg *apiConfig) releaseReplacedAssets(assets []database.Asset) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := cfg.releaseAssets(ctx, assets); err != nil {
+		log.Printf("Couldn't release replaced assets: %v", err)
+	}
+}
+
+// recoverPendingUploads rolls back uploads left pending by requests that
+// never finished, removing any object they managed to write.
+func (cfg *apiConfig) recoverPendingUploads() {
+	uploads, err := cfg.db.GetPendingUploads(time.Now().Add(-pendingUploadTimeout))
+	if err != nil {
+		log.Printf("Couldn't list pending uploads: %v", err)
+		return
+	}
+	for _, upload := range uploads {
+		log.Printf("Rolling back abandoned %s upload %s", upload.Kind, upload.ID)
+		cfg.abortUpload(upload)
+	}
+}
+
+func (cfg *apiConfig) runUploadRecovery(interval time.Duration) {
+	for {
+		cfg.recoverPendingUploads()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// deleteUser finishes deleting a user whose deletion was scheduled. Each
+// video is purged on its own, then the avatar, before the user's rows are
+// deleted, so a failure part way leaves the rest for the next run to pick
+// up.
+func (cfg *apiConfig) deleteUser(user database.User) error {
+	videos, err := cfg.db.GetUserVideos(user.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't list videos: %w", err)
+	}
+	// Scheduling the deletion trashed every video. Trash timestamps only
+	// have second precision, so the cutoff is a second ahead to include
+	// videos trashed just now.
+	cutoff := time.Now().Add(time.Second)
+	for _, video := range videos {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := cfg.purgeVideo(ctx, video, cutoff)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("couldn't purge video %s: %w", video.ID, err)
+		}
+	}
+
+	released, err := cfg.db.SetUserAvatar(user.ID, "", "")
+	if err != nil {
+		return fmt.Errorf("couldn't remove avatar: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := cfg.releaseAssets(ctx, released); err != nil {
+		return err
+	}
+	return cfg.db.DeleteUser(user.ID)
+}
+
+// deleteUsers finishes every scheduled deletion it can.
+func (cfg *apiConfig) deleteUsers() {
+	users, err := cfg.db.GetDeletedUsers()
+	if err != nil {
+		log.Printf("Couldn't list users to delete: %v", err)
+		return
+	}
+	for _, user := range users {
+		if err := cfg.deleteUser(user); err != nil {
+			log.Printf("Couldn't delete user %s: %v", user.ID, err)
+			continue
+		}
+		log.Printf("Deleted user %s who asked to be deleted at %s", user.ID, user.DeletedAt.Format(time.RFC3339))
+	}
+}
+
+// runUserDeleter deletes scheduled users every interval, or as soon as
+// wakeUserDeleter is called.
+func (cfg *apiConfig) runUserDeleter(interval time.Duration) {
+	for {
+		cfg.deleteUsers()
+		select {
+		case <-cfg.userDeletions:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (cfg *apiConfig) wakeUserDeleter() {
+	select {
+	case cfg.userDeletions <- struct{}{}:
+	default:
+	}
+}